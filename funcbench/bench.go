@@ -14,11 +14,18 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,38 +35,429 @@ import (
 	"golang.org/x/perf/benchstat"
 )
 
+// Actions when a benchmark times out.
+const (
+	timeoutFail  = "fail"
+	timeoutSkip  = "skip"
+	timeoutPanic = "panic"
+)
+
+// testTimeoutPanic is the panic message of a test binary exceeding its timeout.
+const testTimeoutPanic = "panic: test timed out after"
+
+// buildError is returned when the benchmarks fail to compile.
+type buildError struct {
+	diagnostics string
+}
+
+func (e *buildError) Error() string {
+	return "benchmark failed to compile:\n" + e.diagnostics
+}
+
+// raceError is returned when the race detector reports a data race.
+type raceError struct {
+	report string
+}
+
+func (e *raceError) Error() string {
+	return "data race detected:\n" + e.report
+}
+
+const raceReportDelimiter = "=================="
+
+// raceReports returns the data race reports from the go test output,
+// or an empty string if no data race was detected.
+func raceReports(out string) string {
+	var (
+		reports []string
+		report  []string
+		inside  bool
+	)
+	for _, line := range strings.Split(out, "\n") {
+		if line == raceReportDelimiter {
+			if inside && len(report) > 0 && report[0] == "WARNING: DATA RACE" {
+				reports = append(reports, strings.Join(report, "\n"))
+			}
+			inside, report = !inside, nil
+			continue
+		}
+		if inside {
+			report = append(report, line)
+		}
+	}
+	return strings.Join(reports, "\n"+raceReportDelimiter+"\n")
+}
+
+var compileErrorRe = regexp.MustCompile(`^\S+\.go:\d+(:\d+)?: `)
+
+// buildDiagnostics returns the compilation errors from the go test output,
+// or an empty string if the packages were built successfully.
+func buildDiagnostics(out string) string {
+	var (
+		diagnostics []string
+		failed      bool
+	)
+	for _, line := range strings.Split(out, "\n") {
+		switch {
+		case strings.HasPrefix(line, "# "), compileErrorRe.MatchString(line):
+			diagnostics = append(diagnostics, line)
+		case strings.HasPrefix(line, "FAIL") && strings.HasSuffix(line, "[build failed]"):
+			diagnostics = append(diagnostics, line)
+			failed = true
+		}
+	}
+	if !failed {
+		return ""
+	}
+	return strings.Join(diagnostics, "\n")
+}
+
+// buildWarnings returns the warnings printed while building the benchmarks, eg. by cgo,
+// along with the package headers they belong to, or an empty string if there are none.
+func buildWarnings(out string) string {
+	var (
+		warnings []string
+		header   string
+	)
+	for _, line := range strings.Split(out, "\n") {
+		switch {
+		// Indented lines are logged by the benchmarks themselves.
+		case strings.HasPrefix(line, " "), strings.HasPrefix(line, "\t"):
+		case strings.HasPrefix(line, "# "):
+			header = line
+		case compileErrorRe.MatchString(line), strings.Contains(line, "warning:"):
+			if header != "" {
+				warnings = append(warnings, header)
+				header = ""
+			}
+			warnings = append(warnings, line)
+		}
+	}
+	return strings.Join(warnings, "\n")
+}
+
 // TODO: Add unit test.
 type Benchmarker struct {
 	logger Logger
 
-	benchmarkArgs  []string
-	benchFunc      string
+	benchmarkArgs []string
+	benchFunc     string
+	// cacheKey identifies the options of the run the results depend on, along with the benchFunc and the commit.
+	cacheKey string
+	// Package regexp of a qualified benchFunc, selecting the benchmarked packages.
+	benchPackageRe *regexp.Regexp
+	packagePaths   []string
 	resultCacheDir string
+	timeoutAction  string
+	// Run the benchmarks once with the output discarded before the measured run.
+	warmup bool
+	// Write the raw results of both compared sides to the resultCacheDir.
+	saveRaw bool
+	// Fail when benchmarks are only present on one of the compared sides.
+	requireParity bool
+	// Show the build warnings of the current side along with the results.
+	reportWarnings bool
+	// Collect a CPU profile of both compared sides and show the difference along with the results.
+	cpuProfile bool
+
+	// Sub-benchmark name patterns compared against each other when the target is '.'.
+	oldSubBenchmark string
+	newSubBenchmark string
+	// Sub-benchmark name element to compare across when the target is '.'.
+	subBenchmarkBy string
 
 	c    *commander
 	repo *git.Repository
+
+	// stream receives the benchmark output while it runs.
+	stream io.Writer
+}
+
+// benchmarkOptions configures how the Benchmarker runs and compares the benchmarks.
+type benchmarkOptions struct {
+	benchTime     time.Duration
+	benchTimeout  time.Duration
+	timeoutAction string
+	count         int
+	packagePaths  []string
+	// Directory to cache the results of the benchmark runs in.
+	resultCacheDir string
+
+	warmup         bool
+	saveRaw        bool
+	requireParity  bool
+	reportWarnings bool
+	cpuProfile     bool
+	race           bool
+	// Match the benchmark function regexp against the package-qualified benchmark name.
+	qualified bool
+
+	oldSubBenchmark string
+	newSubBenchmark string
+	subBenchmarkBy  string
+
+	// Cross compilation target and the command running its benchmarks.
+	goos   string
+	goarch string
+	runner string
+	// KEY=VALUE environment variables of the benchmark command.
+	benchEnv []string
+	// KEY=VALUE environment variables of the build and module caches, which don't change the results.
+	cacheEnv []string
 }
 
-func newBenchmarker(logger Logger, env Environment, c *commander, benchTime time.Duration, benchTimeout time.Duration, resultCacheDir, packagePath string) *Benchmarker {
+func newBenchmarker(logger Logger, env Environment, c *commander, opts benchmarkOptions) (*Benchmarker, error) {
+	benchFunc := env.BenchFunc()
+	var benchPackageRe *regexp.Regexp
+	if opts.qualified {
+		var err error
+		benchPackageRe, benchFunc, err = splitQualifiedBenchFunc(benchFunc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Cross compiled benchmarks can only run through a runner, eg. an emulator.
+	targetOS, targetArch := runtime.GOOS, runtime.GOARCH
+	if opts.goos != "" {
+		targetOS = opts.goos
+	}
+	if opts.goarch != "" {
+		targetArch = opts.goarch
+	}
+	if (targetOS != runtime.GOOS || targetArch != runtime.GOARCH) && opts.runner == "" {
+		return nil, errors.Errorf("benchmarks built for %s/%s can't run on %s/%s without a runner", targetOS, targetArch, runtime.GOOS, runtime.GOARCH)
+	}
+
+	var crossEnv []string
+	if opts.goos != "" {
+		crossEnv = append(crossEnv, "GOOS="+opts.goos)
+	}
+	if opts.goarch != "" {
+		crossEnv = append(crossEnv, "GOARCH="+opts.goarch)
+	}
+	goEnv, err := benchEnvArgs(append(append(append([]string{}, crossEnv...), opts.cacheEnv...), opts.benchEnv...))
+	if err != nil {
+		return nil, err
+	}
+	// TODO(bwplotka): Allow memprofiles.
+	// 'go test' flags: https://golang.org/cmd/go/#hdr-Testing_flags
+	testFlags := []string{
+		"-mod", "vendor",
+		"-run", `"^$"`,
+		"-bench", fmt.Sprintf(`"^%s$"`, benchFunc),
+		"-benchmem",
+		"-benchtime", opts.benchTime.String(),
+		"-count", strconv.Itoa(opts.count),
+		"-timeout", opts.benchTimeout.String(),
+	}
+	if opts.race {
+		testFlags = append(testFlags, "-race")
+	}
+	if opts.runner != "" {
+		testFlags = append(testFlags, "-exec", fmt.Sprintf(`"%s"`, opts.runner))
+	}
+
+	// Results are only reused for runs with the same options, regardless of the order
+	// of the environment variables and packages.
+	keyEnv := append(append([]string{}, crossEnv...), opts.benchEnv...)
+	sort.Strings(keyEnv)
+	pkgs := append([]string{}, opts.packagePaths...)
+	sort.Strings(pkgs)
+	key := append(append([]string{}, keyEnv...), testFlags...)
+	if opts.cpuProfile {
+		// Results without a profile can't be reused for a profiled run.
+		key = append(key, "-cpuprofile")
+	}
+
 	return &Benchmarker{
-		logger:    logger,
-		benchFunc: env.BenchFunc(),
-		benchmarkArgs: []string{
-			// TODO(bwplotka): Allow memprofiles.
-			// 'go test' flags: https://golang.org/cmd/go/#hdr-Testing_flags
-			"go test",
-			"-mod", "vendor",
-			"-run", `"^$"`,
-			"-bench", fmt.Sprintf(`"^%s$"`, env.BenchFunc()),
-			"-benchmem",
-			"-benchtime", benchTime.String(),
-			"-timeout", benchTimeout.String(),
-			packagePath,
-		},
-		c:              c,
-		repo:           env.Repo(),
-		resultCacheDir: resultCacheDir,
+		logger:          logger,
+		benchFunc:       env.BenchFunc(),
+		cacheKey:        strings.Join(append(key, pkgs...), " "),
+		benchPackageRe:  benchPackageRe,
+		packagePaths:    opts.packagePaths,
+		timeoutAction:   opts.timeoutAction,
+		warmup:          opts.warmup,
+		saveRaw:         opts.saveRaw,
+		requireParity:   opts.requireParity,
+		reportWarnings:  opts.reportWarnings,
+		cpuProfile:      opts.cpuProfile,
+		oldSubBenchmark: opts.oldSubBenchmark,
+		newSubBenchmark: opts.newSubBenchmark,
+		subBenchmarkBy:  opts.subBenchmarkBy,
+		benchmarkArgs:   append(append(append(goEnv, "go test"), testFlags...), opts.packagePaths...),
+		c:               c,
+		repo:            env.Repo(),
+		resultCacheDir:  opts.resultCacheDir,
+		stream:          os.Stdout,
+	}, nil
+}
+
+// benchEnvArgs validates the KEY=VALUE environment variables and returns them quoted,
+// to prefix the benchmark command with.
+func benchEnvArgs(env []string) ([]string, error) {
+	var (
+		args []string
+		seen = map[string]struct{}{}
+	)
+	for _, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || !envKeyRe.MatchString(kv[0]) {
+			return nil, errors.Errorf("environment variable %q has to be of the form KEY=VALUE", e)
+		}
+		if _, ok := seen[kv[0]]; ok {
+			return nil, errors.Errorf("environment variable %s is set more than once", kv[0])
+		}
+		seen[kv[0]] = struct{}{}
+		args = append(args, kv[0]+"='"+strings.Replace(kv[1], "'", `'\''`, -1)+"'")
 	}
+	return args, nil
+}
+
+var envKeyRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// buildCacheEnv creates the build and module cache directories in dir and returns
+// the environment variables to share them between the benchmarks of both compared sides.
+func buildCacheEnv(dir string) ([]string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	env := []string{
+		"GOCACHE=" + filepath.Join(dir, "build"),
+		"GOMODCACHE=" + filepath.Join(dir, "mod"),
+	}
+	for _, e := range env {
+		if err := os.MkdirAll(strings.SplitN(e, "=", 2)[1], os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	return env, nil
+}
+
+// removeBuildCache removes the build cache directory. The module cache is read-only,
+// so the directories are made writable first.
+func removeBuildCache(dir string) error {
+	if err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil || !f.IsDir() {
+			return err
+		}
+		return os.Chmod(path, f.Mode()|0200)
+	}); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// benchSelection returns the regexp selecting the union of the benchmarks matching benchFuncRegex
+// and the benchmarks named in benchList. When benchFuncRegex is the default '.*',
+// only the listed benchmarks are selected.
+func benchSelection(benchFuncRegex string, benchList []string) (string, error) {
+	if len(benchList) == 0 {
+		return benchFuncRegex, nil
+	}
+	// go test splits the regexp by slashes to match sub-benchmarks, which doesn't work within a group.
+	if strings.Contains(benchFuncRegex, "/") {
+		return "", errors.Errorf("benchmark list can't be combined with the sub-benchmark regex %q", benchFuncRegex)
+	}
+
+	var alternatives []string
+	if benchFuncRegex != ".*" {
+		alternatives = append(alternatives, "(?:"+benchFuncRegex+")")
+	}
+	for _, name := range benchList {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return "", errors.New("benchmark list contains an empty name")
+		}
+		alternatives = append(alternatives, regexp.QuoteMeta(name))
+	}
+	return "(?:" + strings.Join(alternatives, "|") + ")", nil
+}
+
+// splitQualifiedBenchFunc splits a package-qualified benchmark regexp,
+// eg. 'storage/.*\.BenchmarkAppend', into the package regexp and the benchmark function regexp.
+// The package regexp is anchored to match whole trailing elements of the package import path.
+func splitQualifiedBenchFunc(benchFunc string) (*regexp.Regexp, string, error) {
+	i := strings.LastIndex(benchFunc, `\.`)
+	if i < 0 {
+		return nil, "", errors.Errorf(`qualified benchmark regex %q has to be of the form <package regex>\.<benchmark regex>`, benchFunc)
+	}
+	pkgRe, err := regexp.Compile("(?:^|/)(?:" + benchFunc[:i] + ")$")
+	if err != nil {
+		return nil, "", errors.Wrap(err, "package regex")
+	}
+	return pkgRe, benchFunc[i+2:], nil
+}
+
+// matchingPackages returns the import paths of the packages matching the benchPackageRe.
+func (b *Benchmarker) matchingPackages(pkgRoot string, packagePaths []string) ([]string, error) {
+	out, err := b.c.exec("sh", "-c", strings.Join(append([]string{"cd", pkgRoot, "&&", "go", "list"}, packagePaths...), " "))
+	if err != nil {
+		return nil, errors.Wrap(err, "list packages")
+	}
+
+	var pkgs []string
+	for _, pkg := range strings.Fields(out) {
+		if b.benchPackageRe.MatchString(pkg) {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	if len(pkgs) == 0 {
+		return nil, errors.Errorf("no package matched %q", b.benchPackageRe.String())
+	}
+	return pkgs, nil
+}
+
+// list returns the package-qualified names of the benchmarks in pkgRoot that would be run, without running them.
+func (b *Benchmarker) list(pkgRoot string) ([]string, error) {
+	benchFunc, pkgs := b.benchFunc, b.packagePaths
+	if b.benchPackageRe != nil {
+		var err error
+		if _, benchFunc, err = splitQualifiedBenchFunc(benchFunc); err != nil {
+			return nil, err
+		}
+		if pkgs, err = b.matchingPackages(pkgRoot, pkgs); err != nil {
+			return nil, err
+		}
+	}
+
+	out, err := b.c.exec("sh", "-c", strings.Join(append([]string{"cd", pkgRoot, "&&", "go", "test", "-mod", "vendor", "-list", "^Benchmark"}, pkgs...), " "))
+	if err != nil {
+		if diagnostics := buildDiagnostics(out); diagnostics != "" {
+			return nil, &buildError{diagnostics: diagnostics}
+		}
+		return nil, errors.Wrap(err, "list benchmarks")
+	}
+	return parseBenchmarkList(out, benchFunc)
+}
+
+// parseBenchmarkList returns the package-qualified names of the benchmarks in the output of
+// 'go test -list' matching the benchFunc regexp.
+// Only the top-level benchmarks are listed, so sub-benchmark patterns of the regexp are ignored.
+func parseBenchmarkList(out, benchFunc string) ([]string, error) {
+	re, err := regexp.Compile(fmt.Sprintf("^%s$", strings.SplitN(benchFunc, "/", 2)[0]))
+	if err != nil {
+		return nil, errors.Wrap(err, "benchmark regex")
+	}
+
+	var names, matched []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 1 && strings.HasPrefix(fields[0], "Benchmark"):
+			if re.MatchString(fields[0]) {
+				names = append(names, fields[0])
+			}
+		// The package is printed after its benchmarks.
+		case len(fields) >= 2 && fields[0] == "ok":
+			for _, n := range names {
+				matched = append(matched, fields[1]+"."+n)
+			}
+			names = nil
+		}
+	}
+	return matched, nil
 }
 
 func (b *Benchmarker) benchOutFileName(commit plumbing.Hash) (string, error) {
@@ -73,29 +471,121 @@ func (b *Benchmarker) benchOutFileName(commit plumbing.Hash) (string, error) {
 		return "", err
 	}
 
-	return fmt.Sprintf("%s-%s.out", bb.String(), commit.String()), nil
+	key := sha256.Sum256([]byte(b.cacheKey))
+	return fmt.Sprintf("%s-%s-%s.out", bb.String(), hex.EncodeToString(key[:6]), commit.String()), nil
+}
+
+// existingPackages returns the package paths to benchmark in pkgRoot. A relative package path whose
+// directory doesn't exist is an error, unless allowMissing is set, eg. for a package added by the
+// compared changes, which is left out so that its benchmarks are reported as added.
+func (b *Benchmarker) existingPackages(pkgRoot string, allowMissing bool) ([]string, error) {
+	var pkgs []string
+	for _, p := range b.packagePaths {
+		if strings.HasPrefix(p, "./") || strings.HasPrefix(p, "../") {
+			dir := filepath.Join(pkgRoot, strings.TrimSuffix(p, "..."))
+			if f, err := os.Stat(dir); err != nil || !f.IsDir() {
+				if !allowMissing {
+					return nil, errors.Errorf("package path %s doesn't exist in %s", p, pkgRoot)
+				}
+				b.logger.Println("Package path", p, "doesn't exist in", pkgRoot, "skipping it.")
+				continue
+			}
+		}
+		pkgs = append(pkgs, p)
+	}
+	return pkgs, nil
 }
 
+// exec runs the benchmarks of the current side in pkgRoot and returns the file with the results.
 func (b *Benchmarker) exec(pkgRoot string, commit plumbing.Hash) (string, error) {
+	return b.execSide(pkgRoot, commit, false)
+}
+
+// execTarget runs the benchmarks of the compared target in pkgRoot and returns the file with the results.
+// Package paths missing in the target are skipped.
+func (b *Benchmarker) execTarget(pkgRoot string, commit plumbing.Hash) (string, error) {
+	return b.execSide(pkgRoot, commit, true)
+}
+
+func (b *Benchmarker) execSide(pkgRoot string, commit plumbing.Hash, target bool) (string, error) {
 	fileName, err := b.benchOutFileName(commit)
 	if err != nil {
 		return "", err
 	}
 
-	if _, err := ioutil.ReadFile(filepath.Join(b.resultCacheDir, fileName)); err == nil {
+	// Results of uncommitted changes are never reused.
+	if _, err := ioutil.ReadFile(filepath.Join(b.resultCacheDir, fileName)); err == nil && commit != plumbing.ZeroHash {
 		fmt.Println("Found previous results for ", fileName, b.benchFunc, "Reusing.")
 		return filepath.Join(b.resultCacheDir, fileName), nil
 	}
 
+	// The package paths are at the end of the arguments.
+	args := b.benchmarkArgs[:len(b.benchmarkArgs)-len(b.packagePaths)]
+	pkgs, err := b.existingPackages(pkgRoot, target)
+	if err != nil {
+		return "", err
+	}
+	if len(pkgs) == 0 && len(b.packagePaths) > 0 {
+		// Nothing to run in the target, all the benchmarks were added by the compared changes.
+		b.logger.Println("None of the package paths exist in", pkgRoot, "no benchmarks to run for", commit.String())
+		return b.saveResults(fileName, "")
+	}
+	if b.benchPackageRe != nil {
+		if pkgs, err = b.matchingPackages(pkgRoot, pkgs); err != nil {
+			return "", err
+		}
+	}
+	if b.cpuProfile {
+		if len(pkgs) != 1 || strings.HasSuffix(pkgs[0], "...") {
+			return "", errors.Errorf("CPU profiles can only be collected for a single package, got %v", pkgs)
+		}
+		profile, err := filepath.Abs(cpuProfileFile(filepath.Join(b.resultCacheDir, fileName)))
+		if err != nil {
+			return "", err
+		}
+		// Keep the test binary next to the profile instead of in the package root.
+		args = append(append([]string{}, args...), "-cpuprofile", profile, "-o", strings.TrimSuffix(profile, ".prof")+".test")
+	}
+	args = append(append([]string{}, args...), pkgs...)
+
 	// TODO Switch working directory before entering this function.
-	benchCmd := []string{"sh", "-c", strings.Join(append([]string{"cd", pkgRoot, "&&"}, b.benchmarkArgs...), " ")}
+	benchCmd := []string{"sh", "-c", strings.Join(append([]string{"cd", pkgRoot, "&&"}, args...), " ")}
+
+	if b.warmup {
+		b.logger.Println("Executing warmup run for", commit.String())
+		if _, err := b.c.exec(benchCmd...); err != nil {
+			return "", errors.Wrap(err, "warmup run")
+		}
+	}
 
 	b.logger.Println("Executing benchmark command for", commit.String(), "\n", benchCmd)
-	out, err := b.c.exec(benchCmd...)
+	// Always stream the output, to show the progress of long running benchmarks.
+	out, err := b.c.execStream(b.stream, benchCmd...)
+	if err != nil && strings.Contains(out, testTimeoutPanic) {
+		switch b.timeoutAction {
+		case timeoutFail:
+			return "", errors.New("benchmark timed out")
+		case timeoutSkip:
+			b.logger.Println("Benchmark timed out, continuing with the results of the benchmarks finished before.")
+			// Partial results are not reused.
+			fileName += ".partial"
+			err = nil
+		}
+	}
+	if reports := raceReports(out); reports != "" {
+		return "", &raceError{report: reports}
+	}
 	if err != nil {
+		if diagnostics := buildDiagnostics(out); diagnostics != "" {
+			return "", &buildError{diagnostics: diagnostics}
+		}
 		return "", errors.Wrap(err, "benchmark ended with an error.")
 	}
+	return b.saveResults(fileName, out)
+}
 
+// saveResults writes the benchmark output to the result cache and returns its path.
+func (b *Benchmarker) saveResults(fileName, out string) (string, error) {
 	fn := filepath.Join(b.resultCacheDir, fileName)
 	if b.resultCacheDir != "" {
 		if err := os.MkdirAll(b.resultCacheDir, os.ModePerm); err != nil {
@@ -108,12 +598,267 @@ func (b *Benchmarker) exec(pkgRoot string, commit plumbing.Hash) (string, error)
 	return fn, nil
 }
 
-func (b *Benchmarker) compareSubBenchmarks(string) ([]*benchstat.Table, error) {
-	// TODO(bwplotka): Implement.
-	return nil, errors.New("not implemented")
+// buildWarningsNote returns a note with the build warnings in the result file,
+// or an empty string if there are none or reporting them is disabled.
+func (b *Benchmarker) buildWarningsNote(result string) (string, error) {
+	if !b.reportWarnings {
+		return "", nil
+	}
+	out, err := ioutil.ReadFile(result)
+	if err != nil {
+		return "", err
+	}
+	warnings := buildWarnings(string(out))
+	if warnings == "" {
+		return "", nil
+	}
+	return fmt.Sprintf("⚠️ Build warnings:\n```\n%s\n```", warnings), nil
 }
 
-func compareBenchmarks(files ...string) ([]*benchstat.Table, error) {
+// cpuProfileFile returns the file the CPU profile of the benchmark run with the result file is written to.
+func cpuProfileFile(result string) string {
+	return strings.TrimSuffix(result, ".partial") + ".cpu.prof"
+}
+
+// cpuProfileDiff returns a collapsible note with the top functions of the difference between the CPU profiles
+// of the old and new result files, or an empty string if CPU profiling is disabled or a profile is missing.
+func (b *Benchmarker) cpuProfileDiff(oldResult, newResult string) (string, error) {
+	if !b.cpuProfile {
+		return "", nil
+	}
+	oldProfile, newProfile := cpuProfileFile(oldResult), cpuProfileFile(newResult)
+	for _, p := range []string{oldProfile, newProfile} {
+		if _, err := os.Stat(p); err != nil {
+			b.logger.Println("No CPU profile found at", p, "skipping the CPU profile diff.")
+			return "", nil
+		}
+	}
+
+	out, err := b.c.exec("go", "tool", "pprof", "-top", "-nodecount=20", "-diff_base", oldProfile, newProfile)
+	if err != nil {
+		return "", errors.Wrap(err, "diff CPU profiles")
+	}
+	return fmt.Sprintf("<details><summary>CPU profile diff (new - old)</summary>\n\n```\n%s\n```\n</details>", strings.TrimSpace(out)), nil
+}
+
+// saveRawResults copies the old and new results to old.txt and new.txt in the resultCacheDir
+// when enabled, so that they can be compared with benchstat or archived.
+func (b *Benchmarker) saveRawResults(oldResult, newResult string) error {
+	if !b.saveRaw {
+		return nil
+	}
+	if b.resultCacheDir != "" {
+		if err := os.MkdirAll(b.resultCacheDir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	for name, result := range map[string]string{"old.txt": oldResult, "new.txt": newResult} {
+		content, err := ioutil.ReadFile(result)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(b.resultCacheDir, name), content, 0644); err != nil {
+			return err
+		}
+	}
+	b.logger.Println("Saved raw results to", filepath.Join(b.resultCacheDir, "old.txt"), "and", filepath.Join(b.resultCacheDir, "new.txt"))
+	return nil
+}
+
+// switchToWorkTree does a best effort cleanup of a worktree left at dir by a previous run
+// and checks out the commit in a new worktree at dir.
+func (b *Benchmarker) switchToWorkTree(dir string, commit plumbing.Hash) error {
+	if err := b.removeWorkTree(dir); err != nil {
+		return err
+	}
+
+	b.logger.Println("Checking out (in new workdir):", dir, "commmit", commit.String())
+	if _, err := b.c.exec("git", "worktree", "add", "-f", dir, commit.String()); err != nil {
+		return errors.Wrapf(err, "checkout %s in worktree %s", commit.String(), dir)
+	}
+	return nil
+}
+
+// removeWorkTree deletes the worktree at dir.
+func (b *Benchmarker) removeWorkTree(dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Wrapf(err, "delete worktree at %s", dir)
+	}
+
+	// TODO (geekodour): switch to worktree remove once we decide not to support git<2.17
+	if _, err := b.c.exec("git", "worktree", "prune"); err != nil {
+		return errors.Wrap(err, "worktree prune")
+	}
+	return nil
+}
+
+// compareSubBenchmarks compares two groups of sub-benchmarks from a single result file.
+// Every benchmark with a sub-benchmark name element fully matching oldSubBenchmark is
+// compared against the benchmark with the same name where that element fully matches newSubBenchmark.
+// Eg. with old 'size=small' and new 'size=large', BenchmarkFoo/size=small/op=read is
+// compared with BenchmarkFoo/size=large/op=read.
+func (b *Benchmarker) compareSubBenchmarks(file string) ([]*benchstat.Table, error) {
+	if b.subBenchmarkBy != "" {
+		if b.oldSubBenchmark != "" || b.newSubBenchmark != "" {
+			return nil, errors.New("sub-benchmark dimension can't be used together with old and new sub-benchmark patterns")
+		}
+		return b.compareSubBenchmarksBy(file)
+	}
+	if b.oldSubBenchmark == "" || b.newSubBenchmark == "" {
+		return nil, errors.New("both old and new sub-benchmark patterns are required to compare sub-benchmarks")
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	oldRe, err := regexp.Compile("^(?:" + b.oldSubBenchmark + ")$")
+	if err != nil {
+		return nil, errors.Wrap(err, "old sub-benchmark pattern")
+	}
+	newRe, err := regexp.Compile("^(?:" + b.newSubBenchmark + ")$")
+	if err != nil {
+		return nil, errors.Wrap(err, "new sub-benchmark pattern")
+	}
+
+	oldResult := filterSubBenchmarks(string(content), oldRe)
+	if oldResult == "" {
+		return nil, errors.Errorf("no sub-benchmarks matched %q", b.oldSubBenchmark)
+	}
+	newResult := filterSubBenchmarks(string(content), newRe)
+	if newResult == "" {
+		return nil, errors.Errorf("no sub-benchmarks matched %q", b.newSubBenchmark)
+	}
+
+	c := &benchstat.Collection{
+		DeltaTest: benchstat.NoDeltaTest,
+	}
+	c.AddConfig(b.oldSubBenchmark, []byte(oldResult))
+	c.AddConfig(b.newSubBenchmark, []byte(newResult))
+
+	tables := c.Tables()
+	if tables == nil {
+		return nil, errors.New("didn't match any existing benchmarks")
+	}
+	return tables, nil
+}
+
+// compareSubBenchmarksBy compares sub-benchmarks across the values of the sub-benchmark
+// name element subBenchmarkBy while holding the other elements fixed.
+// Eg. with 'samples', BenchmarkFoo/series=10/samples=100 is compared with
+// BenchmarkFoo/series=10/samples=1000, and a table is returned for every
+// combination of the other elements, here series=10.
+func (b *Benchmarker) compareSubBenchmarksBy(file string) ([]*benchstat.Table, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		values       []string
+		combinations []string
+		// Result lines by combination and value.
+		results = map[string]map[string][]string{}
+	)
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+
+		name := fields[0]
+		procs := procsSuffixRe.FindString(name)
+		elems := strings.Split(strings.TrimSuffix(name, procs), "/")
+
+		kept := elems[:1]
+		value := ""
+		for _, e := range elems[1:] {
+			if value == "" && strings.HasPrefix(e, b.subBenchmarkBy+"=") {
+				value = e
+				continue
+			}
+			kept = append(kept, e)
+		}
+		if value == "" {
+			return nil, errors.Errorf("sub-benchmark dimension %q is not present in %s", b.subBenchmarkBy, name)
+		}
+
+		combination := strings.Join(kept[1:], "/")
+		if _, ok := results[combination]; !ok {
+			combinations = append(combinations, combination)
+			results[combination] = map[string][]string{}
+		}
+		if !containsString(values, value) {
+			values = append(values, value)
+		}
+		fields[0] = strings.Join(kept, "/") + procs
+		results[combination][value] = append(results[combination][value], strings.Join(fields, " "))
+	}
+	if len(values) < 2 {
+		return nil, errors.Errorf("sub-benchmark dimension %q needs at least two values to compare, got %v", b.subBenchmarkBy, values)
+	}
+
+	var tables []*benchstat.Table
+	for _, combination := range combinations {
+		c := &benchstat.Collection{
+			DeltaTest: benchstat.NoDeltaTest,
+		}
+		for _, value := range values {
+			c.AddConfig(value, []byte(strings.Join(results[combination][value], "\n")))
+		}
+		tables = append(tables, c.Tables()...)
+	}
+	if tables == nil {
+		return nil, errors.New("didn't match any existing benchmarks")
+	}
+	return tables, nil
+}
+
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+var procsSuffixRe = regexp.MustCompile(`-\d+$`)
+
+// filterSubBenchmarks returns the benchmark result lines having a sub-benchmark name
+// element matching re, with that element removed from the benchmark name.
+func filterSubBenchmarks(content string, re *regexp.Regexp) string {
+	var out []string
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+
+		name := fields[0]
+		procs := procsSuffixRe.FindString(name)
+		elems := strings.Split(strings.TrimSuffix(name, procs), "/")
+
+		kept := elems[:1]
+		matched := false
+		for _, e := range elems[1:] {
+			if !matched && re.MatchString(e) {
+				matched = true
+				continue
+			}
+			kept = append(kept, e)
+		}
+		if !matched {
+			continue
+		}
+		fields[0] = strings.Join(kept, "/") + procs
+		out = append(out, strings.Join(fields, " "))
+	}
+	return strings.Join(out, "\n")
+}
+
+func collectBenchmarks(files ...string) (*benchstat.Collection, error) {
 	c := &benchstat.Collection{
 		DeltaTest: benchstat.NoDeltaTest,
 	}
@@ -129,6 +874,27 @@ func compareBenchmarks(files ...string) ([]*benchstat.Table, error) {
 			return nil, err
 		}
 	}
+	return c, nil
+}
+
+func compareBenchmarks(files ...string) ([]*benchstat.Table, error) {
+	c, err := collectBenchmarks(files...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if hasBenchmarks(c, file) {
+			continue
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if unexpectedOutput(string(content)) {
+			return nil, errors.Errorf("no benchmark results could be parsed from %s, output:\n%s", file, truncateOutput(string(content), maxOutputExcerpt))
+		}
+	}
 
 	tables := c.Tables()
 	if tables == nil {
@@ -137,3 +903,85 @@ func compareBenchmarks(files ...string) ([]*benchstat.Table, error) {
 
 	return tables, nil
 }
+
+// validateBenchmarkFile checks that the file contains parsable benchmark results.
+func validateBenchmarkFile(file string) error {
+	c, err := collectBenchmarks(file)
+	if err != nil {
+		return err
+	}
+	if len(c.Groups) == 0 {
+		return errors.New("no benchmark results found")
+	}
+	return nil
+}
+
+// hasBenchmarks returns whether any benchmark results were collected from the file.
+func hasBenchmarks(c *benchstat.Collection, file string) bool {
+	for k := range c.Metrics {
+		if k.Config == file {
+			return true
+		}
+	}
+	return false
+}
+
+// unexpectedOutput returns whether the go test output has lines other than the ones
+// printed when no benchmark ran, eg. the output of a panic or of a custom harness.
+func unexpectedOutput(out string) bool {
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "", line == "PASS",
+			strings.HasPrefix(line, "ok "), strings.HasPrefix(line, "? "),
+			strings.HasPrefix(line, "goos:"), strings.HasPrefix(line, "goarch:"),
+			strings.HasPrefix(line, "pkg:"), strings.HasPrefix(line, "cpu:"):
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// maxOutputExcerpt is the maximum number of lines of raw output included in errors.
+const maxOutputExcerpt = 30
+
+// truncateOutput returns the first maxLines lines of the output.
+func truncateOutput(out string, maxLines int) string {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) <= maxLines {
+		return strings.Join(lines, "\n")
+	}
+	return strings.Join(lines[:maxLines], "\n") + fmt.Sprintf("\n... (%d more lines)", len(lines)-maxLines)
+}
+
+// diffBenchmarkSets returns the benchmarks only present in the new results
+// and the ones only present in the old results.
+// Those are left out of the compared tables.
+func diffBenchmarkSets(oldFile, newFile string) (added, removed []string, err error) {
+	c, err := collectBenchmarks(oldFile, newFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	inConfig := func(config, group, benchmark string) bool {
+		for _, unit := range c.Units {
+			if _, ok := c.Metrics[benchstat.Key{Config: config, Group: group, Benchmark: benchmark, Unit: unit}]; ok {
+				return true
+			}
+		}
+		return false
+	}
+	for _, group := range c.Groups {
+		for _, benchmark := range c.Benchmarks[group] {
+			inOld, inNew := inConfig(oldFile, group, benchmark), inConfig(newFile, group, benchmark)
+			switch {
+			case inNew && !inOld:
+				added = append(added, benchmark)
+			case inOld && !inNew:
+				removed = append(removed, benchmark)
+			}
+		}
+	}
+	return added, removed, nil
+}
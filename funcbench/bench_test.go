@@ -0,0 +1,902 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// testBenchmarkOptions returns the options of a single run of the benchmarks in the packages.
+func testBenchmarkOptions(packagePaths ...string) benchmarkOptions {
+	return benchmarkOptions{
+		benchTime:     time.Second,
+		benchTimeout:  time.Hour,
+		timeoutAction: timeoutFail,
+		count:         1,
+		packagePaths:  packagePaths,
+	}
+}
+
+func TestBenchmarkerPackages(t *testing.T) {
+	env := &Local{environment: environment{benchFunc: "BenchmarkFoo"}}
+	b, err := newBenchmarker(nil, env, nil, testBenchmarkOptions("./tsdb", "./promql/..."))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := strings.Join(b.benchmarkArgs, " ")
+	if !strings.HasSuffix(cmd, " ./tsdb ./promql/...") {
+		t.Errorf("Expected packages at the end of the benchmark command, got %q", cmd)
+	}
+
+	dir, err := ioutil.TempDir("", "test_packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "tsdb"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	b.logger = log.New(ioutil.Discard, "", 0)
+	b.c = &commander{ctx: context.Background()}
+	b.benchmarkArgs = []string{"echo", "./tsdb", "./promql/..."}
+	b.resultCacheDir = dir
+
+	// A package path missing in the current side, eg. a typo, is an error.
+	if _, err := b.exec(dir, plumbing.ZeroHash); err == nil || !strings.Contains(err.Error(), "package path ./promql/... doesn't exist") {
+		t.Errorf("Expected an error about the missing package path, got %v", err)
+	}
+
+	// Only the packages existing in the target are benchmarked.
+	fn, err := b.execTarget(dir, plumbing.ZeroHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "./tsdb" {
+		t.Errorf("Expected only the existing package to be benchmarked, got %q", got)
+	}
+
+	// Without any existing package there are no results for the target.
+	if err := os.RemoveAll(filepath.Join(dir, "tsdb")); err != nil {
+		t.Fatal(err)
+	}
+	if fn, err = b.execTarget(dir, plumbing.ZeroHash); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = ioutil.ReadFile(fn); err != nil || len(out) != 0 {
+		t.Errorf("Expected empty results, got %q, %v", out, err)
+	}
+}
+
+func TestBenchmarkerCacheKey(t *testing.T) {
+	env := &Local{environment: environment{benchFunc: "BenchmarkFoo"}}
+	fileName := func(opts benchmarkOptions) string {
+		b, err := newBenchmarker(nil, env, nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn, err := b.benchOutFileName(plumbing.NewHash("7e4a8f1c2f2d7c1b3a4e5f60718293a4b5c6d7e8"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+
+	tsdb := fileName(testBenchmarkOptions("./tsdb"))
+	if fn := fileName(testBenchmarkOptions("./promql")); fn == tsdb {
+		t.Errorf("Expected different result files for different packages, got %q", fn)
+	}
+	if a, b := fileName(testBenchmarkOptions("./tsdb", "./promql")), fileName(testBenchmarkOptions("./promql", "./tsdb")); a != b {
+		t.Errorf("Expected the same result file regardless of the package order, got %q and %q", a, b)
+	}
+
+	for name, set := range map[string]func(*benchmarkOptions){
+		"race":       func(o *benchmarkOptions) { o.race = true },
+		"count":      func(o *benchmarkOptions) { o.count = 5 },
+		"goarch":     func(o *benchmarkOptions) { o.goarch, o.runner = "arm64", "qemu-aarch64" },
+		"bench-env":  func(o *benchmarkOptions) { o.benchEnv = []string{"GOGC=off"} },
+		"cpuprofile": func(o *benchmarkOptions) { o.cpuProfile = true },
+	} {
+		opts := testBenchmarkOptions("./tsdb")
+		set(&opts)
+		if fn := fileName(opts); fn == tsdb {
+			t.Errorf("Expected a different result file with %s set, got %q", name, fn)
+		}
+	}
+
+	envOpts := func(env ...string) benchmarkOptions {
+		opts := testBenchmarkOptions("./tsdb")
+		opts.benchEnv = env
+		return opts
+	}
+	if a, b := fileName(envOpts("GOGC=off", "GOMAXPROCS=2")), fileName(envOpts("GOMAXPROCS=2", "GOGC=off")); a != b {
+		t.Errorf("Expected the same result file regardless of the environment order, got %q and %q", a, b)
+	}
+
+	cacheOpts := testBenchmarkOptions("./tsdb")
+	cacheOpts.cacheEnv = []string{"GOCACHE=/tmp/cache/build", "GOMODCACHE=/tmp/cache/mod"}
+	if fn := fileName(cacheOpts); fn != tsdb {
+		t.Errorf("Expected the same result file regardless of the build cache, got %q", fn)
+	}
+}
+
+func TestBenchmarkerQualified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_qualified")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"go.mod":                   "module example.com/foo\n",
+		"storage/append_test.go":   "package storage\n\nimport \"testing\"\n\nfunc BenchmarkAppend(b *testing.B) {}\n",
+		"tsdb/append_test.go":      "package tsdb\n\nimport \"testing\"\n\nfunc BenchmarkAppend(b *testing.B) {}\n",
+		"storage/remote/remote.go": "package remote\n",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := testBenchmarkOptions("./...")
+	opts.qualified = true
+	env := &Local{environment: environment{benchFunc: `storage\.BenchmarkAppend`}}
+	b, err := newBenchmarker(nil, env, &commander{ctx: context.Background()}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd := strings.Join(b.benchmarkArgs, " "); !strings.Contains(cmd, `-bench "^BenchmarkAppend$"`) {
+		t.Errorf("Expected the benchmark name regex in the benchmark command, got %q", cmd)
+	}
+
+	pkgs, err := b.matchingPackages(dir, b.packagePaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"example.com/foo/storage"}; !reflect.DeepEqual(expected, pkgs) {
+		t.Errorf("Expected packages %v, got %v", expected, pkgs)
+	}
+
+	env.benchFunc = "BenchmarkAppend"
+	if _, err := newBenchmarker(nil, env, nil, opts); err == nil {
+		t.Error("Expected an error for a benchmark regex without package")
+	}
+}
+
+func TestBenchmarkerCrossCompile(t *testing.T) {
+	env := &Local{environment: environment{benchFunc: "BenchmarkFoo"}}
+
+	otherArch := "arm64"
+	if runtime.GOARCH == otherArch {
+		otherArch = "amd64"
+	}
+	opts := testBenchmarkOptions("./...")
+	opts.goarch = otherArch
+	if _, err := newBenchmarker(nil, env, nil, opts); err == nil {
+		t.Error("Expected an error for cross compiled benchmarks without a runner")
+	}
+
+	opts.goos, opts.runner = "linux", "qemu-"+otherArch
+	b, err := newBenchmarker(nil, env, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := strings.Join(b.benchmarkArgs, " ")
+	if expected := "GOOS='linux' GOARCH='" + otherArch + "' go test "; !strings.HasPrefix(cmd, expected) {
+		t.Errorf("Expected the benchmark command to start with %q, got %q", expected, cmd)
+	}
+	if expected := ` -exec "qemu-` + otherArch + `" `; !strings.Contains(cmd, expected) {
+		t.Errorf("Expected the runner %q in the benchmark command, got %q", expected, cmd)
+	}
+}
+
+func TestBenchmarkerBenchEnv(t *testing.T) {
+	for _, env := range [][]string{{"GOGC"}, {"=50"}, {"GOGC=50", "GOGC=100"}} {
+		if _, err := benchEnvArgs(env); err == nil {
+			t.Errorf("Expected an error for environment %v", env)
+		}
+	}
+
+	args, err := benchEnvArgs([]string{"GOGC=50", "BENCH_OPTS=it's a test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both compared sides run the same command.
+	b := &Benchmarker{
+		logger:        log.New(ioutil.Discard, "", 0),
+		benchFunc:     "BenchmarkFoo",
+		benchmarkArgs: append(args, "env"),
+		c:             &commander{ctx: context.Background()},
+	}
+	var outs []string
+	for _, name := range []string{"a", "b"} {
+		dir, err := ioutil.TempDir("", "test_bench_env_"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		b.resultCacheDir = dir
+		fn, err := b.exec(dir, plumbing.ZeroHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outs = append(outs, string(out))
+	}
+	for _, out := range outs {
+		for _, expected := range []string{"GOGC=50\n", "BENCH_OPTS=it's a test\n"} {
+			if !strings.Contains(out, expected) {
+				t.Errorf("Expected %q in the environment of the benchmark, got:\n%s", expected, out)
+			}
+		}
+	}
+}
+
+func TestBuildCacheEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_build_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	env, err := buildCacheEnv(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, err := benchEnvArgs(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Benchmarker{
+		logger:        log.New(ioutil.Discard, "", 0),
+		benchFunc:     "BenchmarkFoo",
+		benchmarkArgs: append(args, "go", "env", "GOCACHE"),
+		c:             &commander{ctx: context.Background()},
+	}
+	// The target is benchmarked in a worktree below the current one.
+	for _, pkgRoot := range []string{dir, filepath.Join(dir, "cache")} {
+		b.resultCacheDir = pkgRoot
+		fn, err := b.exec(pkgRoot, plumbing.ZeroHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := filepath.Join(dir, "cache", "build"); strings.TrimSpace(string(out)) != expected {
+			t.Errorf("Expected GOCACHE %s for %s, got %s", expected, pkgRoot, out)
+		}
+	}
+}
+
+func TestRemoveBuildCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_remove_build_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Like the module cache, which is read-only.
+	mod := filepath.Join(dir, "mod", "example.com", "foo@v1.0.0")
+	if err := os.MkdirAll(mod, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(mod, "foo.go"), []byte("package foo"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{mod, filepath.Dir(mod)} {
+		if err := os.Chmod(d, 0555); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := removeBuildCache(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Expected the build cache to be removed, got %v", err)
+	}
+}
+
+func TestBenchSelection(t *testing.T) {
+	names := []string{
+		"BenchmarkAppend",
+		"BenchmarkAppendFast",
+		"BenchmarkQuery",
+		"BenchmarkQuerySelect",
+		"BenchmarkRange",
+	}
+	for _, tcase := range []struct {
+		regex    string
+		list     []string
+		expected []string
+	}{
+		{regex: ".*", list: nil, expected: names},
+		{regex: ".*", list: []string{"BenchmarkAppend", "BenchmarkQuery"}, expected: []string{"BenchmarkAppend", "BenchmarkQuery"}},
+		{regex: "BenchmarkQuery.*", list: []string{"BenchmarkAppend"}, expected: []string{"BenchmarkAppend", "BenchmarkQuery", "BenchmarkQuerySelect"}},
+		{regex: "BenchmarkRange|BenchmarkAppendFast", list: []string{"BenchmarkQuery"}, expected: []string{"BenchmarkAppendFast", "BenchmarkQuery", "BenchmarkRange"}},
+	} {
+		t.Run(tcase.regex, func(t *testing.T) {
+			selection, err := benchSelection(tcase.regex, tcase.list)
+			if err != nil {
+				t.Fatal(err)
+			}
+			re := regexp.MustCompile(fmt.Sprintf("^%s$", selection))
+
+			var got []string
+			for _, n := range names {
+				if re.MatchString(n) {
+					got = append(got, n)
+				}
+			}
+			if !reflect.DeepEqual(tcase.expected, got) {
+				t.Errorf("Expected %v selected by %q, got %v", tcase.expected, selection, got)
+			}
+		})
+	}
+
+	if _, err := benchSelection(".*", []string{"BenchmarkAppend", ""}); err == nil {
+		t.Error("Expected error for an empty benchmark name")
+	}
+	if _, err := benchSelection("BenchmarkQuery/sub", []string{"BenchmarkAppend"}); err == nil {
+		t.Error("Expected error for a sub-benchmark regex")
+	}
+}
+
+func TestParseBenchmarkList(t *testing.T) {
+	out := `BenchmarkAppend
+BenchmarkAppendFast
+BenchmarkQuery
+ok  	github.com/prometheus/prometheus/tsdb	0.016s
+?   	github.com/prometheus/prometheus/cmd/prometheus	[no test files]
+BenchmarkQuery
+BenchmarkRangeQuery
+ok  	github.com/prometheus/prometheus/promql	0.021s
+`
+	for _, tcase := range []struct {
+		benchFunc string
+		expected  []string
+	}{
+		{
+			benchFunc: ".*",
+			expected: []string{
+				"github.com/prometheus/prometheus/tsdb.BenchmarkAppend",
+				"github.com/prometheus/prometheus/tsdb.BenchmarkAppendFast",
+				"github.com/prometheus/prometheus/tsdb.BenchmarkQuery",
+				"github.com/prometheus/prometheus/promql.BenchmarkQuery",
+				"github.com/prometheus/prometheus/promql.BenchmarkRangeQuery",
+			},
+		},
+		{
+			benchFunc: "BenchmarkQuery",
+			expected: []string{
+				"github.com/prometheus/prometheus/tsdb.BenchmarkQuery",
+				"github.com/prometheus/prometheus/promql.BenchmarkQuery",
+			},
+		},
+		{
+			benchFunc: "BenchmarkAppend.*/size=.*",
+			expected: []string{
+				"github.com/prometheus/prometheus/tsdb.BenchmarkAppend",
+				"github.com/prometheus/prometheus/tsdb.BenchmarkAppendFast",
+			},
+		},
+		{benchFunc: "BenchmarkNone"},
+	} {
+		t.Run(tcase.benchFunc, func(t *testing.T) {
+			names, err := parseBenchmarkList(out, tcase.benchFunc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tcase.expected, names) {
+				t.Errorf("Expected %v, got %v", tcase.expected, names)
+			}
+		})
+	}
+}
+
+func TestBenchmarkerWorkTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_worktree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	c := &commander{ctx: context.Background()}
+	for _, cmd := range [][]string{
+		{"git", "init", "-q"},
+		{"git", "-c", "user.name=funcbench", "-c", "user.email=funcbench@example.com", "commit", "-q", "--allow-empty", "-m", "init"},
+	} {
+		if _, err := c.exec(cmd...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	head, err := c.exec("git", "rev-parse", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Benchmarker{logger: log.New(ioutil.Discard, "", 0), c: c}
+	wtDir := filepath.Join(dir, "custom-cmp")
+	if err := b.switchToWorkTree(wtDir, plumbing.NewHash(strings.TrimSpace(head))); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := c.exec("git", "worktree", "list"); !strings.Contains(out, "custom-cmp") {
+		t.Errorf("Expected worktree at %s, got:\n%s", wtDir, out)
+	}
+
+	if err := b.removeWorkTree(wtDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(wtDir); !os.IsNotExist(err) {
+		t.Errorf("Expected worktree directory %s to be removed", wtDir)
+	}
+	if out, _ := c.exec("git", "worktree", "list"); strings.Contains(out, "custom-cmp") {
+		t.Errorf("Expected worktree at %s to be pruned, got:\n%s", wtDir, out)
+	}
+}
+
+func TestBenchmarkerExecUncommitted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_exec_uncommitted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := &Benchmarker{
+		logger:         log.New(ioutil.Discard, "", 0),
+		benchFunc:      "BenchmarkFoo",
+		benchmarkArgs:  []string{"echo", "fresh"},
+		resultCacheDir: dir,
+		c:              &commander{ctx: context.Background()},
+	}
+
+	for _, commit := range []plumbing.Hash{plumbing.ZeroHash, plumbing.NewHash("6ecf0ef2c2dffb796033e5a02219af86ec6584e5")} {
+		fileName, err := b.benchOutFileName(commit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fileName), []byte("cached\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := map[plumbing.Hash]string{
+		plumbing.ZeroHash: "fresh\n",
+		plumbing.NewHash("6ecf0ef2c2dffb796033e5a02219af86ec6584e5"): "cached\n",
+	}
+	for commit, expected := range testCases {
+		fn, err := b.exec(dir, commit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != expected {
+			t.Errorf("Expected results %q for %s, got %q", expected, commit, out)
+		}
+	}
+}
+
+func TestBenchmarkerExecWarmup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_exec_warmup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	runs := filepath.Join(dir, "runs")
+	b := &Benchmarker{
+		logger:         log.New(ioutil.Discard, "", 0),
+		benchFunc:      "BenchmarkFoo",
+		benchmarkArgs:  []string{"echo", "run", ">>", runs, "&&", "cat", runs},
+		resultCacheDir: dir,
+		c:              &commander{ctx: context.Background()},
+	}
+
+	for _, warmup := range []bool{false, true} {
+		os.Remove(runs)
+		b.warmup = warmup
+		fn, err := b.exec(dir, plumbing.ZeroHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "run\n"
+		if warmup {
+			// The measured run follows the discarded warmup run.
+			expected = "run\nrun\n"
+		}
+		if string(out) != expected {
+			t.Errorf("Expected results %q with warmup %v, got %q", expected, warmup, out)
+		}
+	}
+}
+
+func TestBenchmarkerSaveRawResults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_save_raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	results := map[string]string{
+		"old.txt": "BenchmarkFoo-4	1000	1000 ns/op\n",
+		"new.txt": "BenchmarkFoo-4	1000	900 ns/op\n",
+	}
+	oldResult, newResult := filepath.Join(dir, "old.out"), filepath.Join(dir, "new.out")
+	if err := ioutil.WriteFile(oldResult, []byte(results["old.txt"]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(newResult, []byte(results["new.txt"]), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rawDir := filepath.Join(dir, "raw")
+	b := &Benchmarker{
+		logger:         log.New(ioutil.Discard, "", 0),
+		resultCacheDir: rawDir,
+	}
+	if err := b.saveRawResults(oldResult, newResult); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(rawDir); !os.IsNotExist(err) {
+		t.Errorf("Expected no raw results to be written when disabled, got %v", err)
+	}
+
+	b.saveRaw = true
+	if err := b.saveRawResults(oldResult, newResult); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range results {
+		out, err := ioutil.ReadFile(filepath.Join(rawDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != expected {
+			t.Errorf("Expected %q in %s, got %q", expected, name, out)
+		}
+	}
+}
+
+func TestBenchmarkerExecTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_exec_timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := &Benchmarker{
+		logger:    log.New(ioutil.Discard, "", 0),
+		benchFunc: "BenchmarkFoo",
+		benchmarkArgs: []string{
+			"echo", "'BenchmarkFoo-4	1000	1000 ns/op'", "&&",
+			"echo", "'panic: test timed out after 1s'", "&&",
+			"exit", "2",
+		},
+		resultCacheDir: dir,
+		c:              &commander{ctx: context.Background()},
+	}
+
+	testCases := []struct {
+		action string
+		err    string
+	}{
+		{action: timeoutFail, err: "benchmark timed out"},
+		{action: timeoutPanic, err: "panic: test timed out after 1s"},
+		{action: timeoutSkip},
+	}
+	for _, tc := range testCases {
+		b.timeoutAction = tc.action
+		fn, err := b.exec(dir, plumbing.ZeroHash)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("Expected error containing %q for timeout action %s, got %v", tc.err, tc.action, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for timeout action %s: %v", tc.action, err)
+		}
+		out, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(out), "BenchmarkFoo-4") {
+			t.Errorf("Expected partial results for timeout action %s, got %q", tc.action, out)
+		}
+	}
+}
+
+func TestBenchmarkerRace(t *testing.T) {
+	env := &Local{environment: environment{benchFunc: "BenchmarkFoo"}}
+	opts := testBenchmarkOptions("./...")
+	opts.race = true
+	b, err := newBenchmarker(nil, env, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd := strings.Join(b.benchmarkArgs, " "); !strings.Contains(cmd, " -race ") {
+		t.Errorf("Expected -race in the benchmark command, got %q", cmd)
+	}
+
+	out := `goos: linux
+==================
+WARNING: DATA RACE
+Write at 0x00c0000a4010 by goroutine 8:
+  github.com/prometheus/prometheus/tsdb.(*Head).Append()
+      /prometheus/tsdb/head.go:42 +0x64
+==================
+BenchmarkFoo-4	1000	1000 ns/op
+--- FAIL: BenchmarkFoo
+    testing.go:853: race detected during execution of test
+FAIL`
+	expected := `WARNING: DATA RACE
+Write at 0x00c0000a4010 by goroutine 8:
+  github.com/prometheus/prometheus/tsdb.(*Head).Append()
+      /prometheus/tsdb/head.go:42 +0x64`
+	if reports := raceReports(out); reports != expected {
+		t.Errorf("Expected race report:\n%s\ngot:\n%s", expected, reports)
+	}
+	if reports := raceReports("BenchmarkFoo-4	1000	1000 ns/op\nPASS"); reports != "" {
+		t.Errorf("Expected no race report, got:\n%s", reports)
+	}
+
+	dir, err := ioutil.TempDir("", "test_exec_race")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "bench.sh")
+	if err := ioutil.WriteFile(script, []byte("cat <<'EOF'\n"+out+"\nEOF\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	b = &Benchmarker{
+		logger:         log.New(ioutil.Discard, "", 0),
+		benchFunc:      "BenchmarkFoo",
+		benchmarkArgs:  []string{"sh", script},
+		resultCacheDir: dir,
+		c:              &commander{ctx: context.Background()},
+	}
+	_, err = b.exec(dir, plumbing.ZeroHash)
+	if rErr, ok := err.(*raceError); !ok || rErr.report != expected {
+		t.Errorf("Expected a race error with the report, got %v", err)
+	}
+}
+
+func TestBuildDiagnostics(t *testing.T) {
+	out := `# github.com/prometheus/prometheus/tsdb [github.com/prometheus/prometheus/tsdb.test]
+tsdb/head.go:42:2: undefined: foo
+tsdb/head_test.go:100:15: cannot use x (type int) as type string in argument to bar
+FAIL	github.com/prometheus/prometheus/tsdb [build failed]
+FAIL
+`
+	expected := `# github.com/prometheus/prometheus/tsdb [github.com/prometheus/prometheus/tsdb.test]
+tsdb/head.go:42:2: undefined: foo
+tsdb/head_test.go:100:15: cannot use x (type int) as type string in argument to bar
+FAIL	github.com/prometheus/prometheus/tsdb [build failed]`
+	if d := buildDiagnostics(out); d != expected {
+		t.Errorf("Expected diagnostics:\n%s\ngot:\n%s", expected, d)
+	}
+
+	runtimeFailure := `BenchmarkFoo-4	1000	1000 ns/op
+--- FAIL: BenchmarkBar-4
+    bar_test.go:10: unexpected result
+FAIL
+exit status 1
+FAIL	github.com/prometheus/prometheus/tsdb	1.234s
+`
+	if d := buildDiagnostics(runtimeFailure); d != "" {
+		t.Errorf("Expected no diagnostics for a runtime failure, got:\n%s", d)
+	}
+
+	b := &Benchmarker{
+		logger:        log.New(ioutil.Discard, "", 0),
+		benchFunc:     "BenchmarkFoo",
+		benchmarkArgs: []string{"printf", "'%s'", "'" + out + "'", "&&", "exit", "2"},
+		c:             &commander{ctx: context.Background()},
+	}
+	_, err := b.exec(".", plumbing.ZeroHash)
+	if bErr, ok := err.(*buildError); !ok || bErr.diagnostics != expected {
+		t.Errorf("Expected a build error with the diagnostics, got %v", err)
+	}
+}
+
+func TestBuildWarnings(t *testing.T) {
+	out := `# github.com/prometheus/prometheus/tsdb
+tsdb/head.go:42:2: warning: unused variable 'ref' [-Wunused-variable]
+# github.com/prometheus/prometheus/promql
+cgo-gcc-prolog: In function '_cgo_ecb0f6f3d405_Cfunc_foo':
+cgo-gcc-prolog:58:33: warning: 'foo' is deprecated [-Wdeprecated-declarations]
+goos: linux
+goarch: amd64
+pkg: github.com/prometheus/prometheus/tsdb
+BenchmarkFoo-4	1000	1000 ns/op
+--- BENCH: BenchmarkFoo-4
+    head_test.go:10: warning: logged by the benchmark
+PASS
+ok  	github.com/prometheus/prometheus/tsdb	1.234s
+`
+	expected := `# github.com/prometheus/prometheus/tsdb
+tsdb/head.go:42:2: warning: unused variable 'ref' [-Wunused-variable]
+# github.com/prometheus/prometheus/promql
+cgo-gcc-prolog:58:33: warning: 'foo' is deprecated [-Wdeprecated-declarations]`
+	if w := buildWarnings(out); w != expected {
+		t.Errorf("Expected warnings:\n%s\ngot:\n%s", expected, w)
+	}
+	if w := buildWarnings("BenchmarkFoo-4\t1000\t1000 ns/op\nPASS\n"); w != "" {
+		t.Errorf("Expected no warnings, got:\n%s", w)
+	}
+
+	dir, err := ioutil.TempDir("", "test_build_warnings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := &Benchmarker{
+		logger:         log.New(ioutil.Discard, "", 0),
+		benchFunc:      "BenchmarkFoo",
+		benchmarkArgs:  []string{"printf", "'%s'", "'" + strings.Replace(out, "'", "", -1) + "'"},
+		resultCacheDir: dir,
+		reportWarnings: true,
+		c:              &commander{ctx: context.Background()},
+	}
+	result, err := b.exec(".", plumbing.ZeroHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err := b.buildWarningsNote(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(note, "⚠️ Build warnings:\n```\n# github.com/prometheus/prometheus/tsdb\n") {
+		t.Errorf("Expected a note with the build warnings, got:\n%s", note)
+	}
+
+	b.reportWarnings = false
+	if note, err := b.buildWarningsNote(result); err != nil || note != "" {
+		t.Errorf("Expected no note with reporting the warnings disabled, got %q, %v", note, err)
+	}
+}
+
+func TestCPUProfileDiff(t *testing.T) {
+	b := &Benchmarker{
+		logger:     log.New(ioutil.Discard, "", 0),
+		cpuProfile: true,
+		c:          &commander{ctx: context.Background()},
+	}
+	oldResult, newResult := filepath.Join("testdata", "old.out"), filepath.Join("testdata", "new.out")
+
+	diff, err := b.cpuProfileDiff(oldResult, newResult)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(diff, "<details><summary>CPU profile diff (new - old)</summary>") || !strings.Contains(diff, "main.encodeChunk") {
+		t.Errorf("Expected a diff of the CPU profiles with main.encodeChunk, got:\n%s", diff)
+	}
+	// main.appendSamples ran for the same time on both sides.
+	if strings.Contains(diff, "main.appendSamples") {
+		t.Errorf("Expected no difference for main.appendSamples, got:\n%s", diff)
+	}
+
+	if diff, err := b.cpuProfileDiff(oldResult, filepath.Join("testdata", "missing.out")); err != nil || diff != "" {
+		t.Errorf("Expected no diff for a missing profile, got %q, %v", diff, err)
+	}
+
+	b.cpuProfile = false
+	if diff, err := b.cpuProfileDiff(oldResult, newResult); err != nil || diff != "" {
+		t.Errorf("Expected no diff with CPU profiling disabled, got %q, %v", diff, err)
+	}
+
+	b = &Benchmarker{
+		logger:        log.New(ioutil.Discard, "", 0),
+		benchFunc:     "BenchmarkFoo",
+		packagePaths:  []string{"./..."},
+		benchmarkArgs: []string{"go test", "./..."},
+		cpuProfile:    true,
+		c:             &commander{ctx: context.Background()},
+	}
+	if _, err := b.exec(".", plumbing.ZeroHash); err == nil || !strings.Contains(err.Error(), "single package") {
+		t.Errorf("Expected an error profiling multiple packages, got %v", err)
+	}
+}
+
+func TestCompareWithBaselineFile(t *testing.T) {
+	baselineFile := filepath.Join("testdata", "baseline.txt")
+	if err := validateBenchmarkFile(baselineFile); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "test_baseline_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	invalidFile := filepath.Join(dir, "invalid")
+	if err := ioutil.WriteFile(invalidFile, []byte("not a benchmark result\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateBenchmarkFile(invalidFile); err == nil {
+		t.Error("Expected an error for a file without benchmark results")
+	}
+
+	newFile := filepath.Join(dir, "new")
+	newResult := `BenchmarkRespond-4	688	1751880 ns/op
+BenchmarkQuery-4	2553	456152 ns/op
+BenchmarkParse-4	434798	2374 ns/op`
+	if err := ioutil.WriteFile(newFile, []byte(newResult), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tables, info, err := compareResults(baselineFile, newFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info) != 0 {
+		t.Errorf("Expected no added or removed benchmarks, got %v", info)
+	}
+	if len(tables) != 1 || len(tables[0].Rows) != 3 {
+		t.Fatalf("Expected a single table with 3 rows, got %v", tables)
+	}
+	if tables[0].Configs[0] != baselineFile {
+		t.Errorf("Expected old side to be the baseline file, got %s", tables[0].Configs[0])
+	}
+}
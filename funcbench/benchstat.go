@@ -14,27 +14,86 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"math"
+	"os"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
+	"github.com/pkg/errors"
 	"golang.org/x/perf/benchstat"
 )
 
 var renderTemplate = template.Must(template.New("").Funcs(renderFuncs).Parse(`
-{{- range $i, $table := . }}
-Benchmark|Old {{.Metric}}|New {{.Metric}}{{if .OldNewDelta}}|Delta{{end}}
--|-|-{{if .OldNewDelta}}|-{{end}}
+{{- range $i, $table := .Tables }}
+Benchmark{{range columns $table}}|{{.}} {{$table.Metric}}{{end}}{{if .OldNewDelta}}|Delta{{end}}{{if $.Previous}}|vs previous run{{end}}
+-{{range columns $table}}|-{{end}}{{if .OldNewDelta}}|-{{end}}{{if $.Previous}}|-{{end}}
 
 	{{- range $group := group $table.Rows }}
 		{{- range $row := . }}
-{{ .Benchmark }}{{range .Metrics}}|{{.Format $row.Scaler}}{{end}}{{if $table.OldNewDelta}}|{{replace .Delta "-" "−" -1}} {{.Note}}{{ end }}
+{{ .Benchmark }}{{range .Metrics}}|{{.Format $row.Scaler}}{{end}}{{if $table.OldNewDelta}}|{{replace .Delta "-" "−" -1}} {{.Note}}{{ end }}{{if $.Previous}}|{{replace (index $.Previous $row) "-" "−" -1}}{{end}}
 		{{- end }}
 	{{- end }}
 {{ end }}`))
 
+var renderHTMLTemplate = htmltemplate.Must(htmltemplate.New("").Funcs(htmltemplate.FuncMap{
+	"columns": columns,
+	"change": func(c int) string {
+		switch {
+		case c > 0:
+			return "better"
+		case c < 0:
+			return "worse"
+		}
+		return ""
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>funcbench results</title>
+<style>
+table { border-collapse: collapse; margin-bottom: 1em; font-family: monospace; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.better { color: #080; }
+.worse { color: #c00; }
+</style>
+</head>
+<body>
+{{- range $table := .Tables }}
+<table>
+<tr><th>Benchmark</th>{{range columns $table}}<th>{{.}} {{$table.Metric}}</th>{{end}}{{if .OldNewDelta}}<th>Delta</th>{{end}}</tr>
+	{{- range $row := .Rows }}
+<tr><td>{{.Benchmark}}</td>{{range .Metrics}}<td>{{.Format $row.Scaler}}</td>{{end}}{{if $table.OldNewDelta}}<td class="{{change .Change}}">{{.Delta}} {{.Note}}</td>{{end}}</tr>
+	{{- end }}
+</table>
+{{- end }}
+{{- range .Notes }}{{ if . }}
+<p>{{ . }}</p>
+{{- end }}{{ end }}
+</body>
+</html>
+`))
+
 var renderFuncs = template.FuncMap{
 	"replace": strings.Replace,
 	"group":   formGroup,
+	"columns": columns,
+}
+
+// columns returns the headers of the value columns of the table. Tables with more than two
+// configs compare the values of a sub-benchmark dimension, which are shown instead of old and new.
+func columns(t *benchstat.Table) []string {
+	if len(t.Configs) > 2 {
+		return t.Configs
+	}
+	return []string{"Old", "New"}
 }
 
 func formGroup(rows []*benchstat.Row) (out [][]*benchstat.Row) {
@@ -56,6 +115,347 @@ func formGroup(rows []*benchstat.Row) (out [][]*benchstat.Row) {
 	return
 }
 
+type markdownData struct {
+	Tables []*benchstat.Table
+	// Previous holds the delta of each row against the previous run, nil if there is none.
+	Previous map[*benchstat.Row]string
+}
+
 func formatMarkdown(buf *bytes.Buffer, tables []*benchstat.Table) error {
-	return renderTemplate.Execute(buf, tables)
+	return renderTemplate.Execute(buf, markdownData{Tables: tables})
+}
+
+// formatMarkdownWithPrevious renders the tables with an additional column holding
+// the delta of every row against the previous run.
+func formatMarkdownWithPrevious(buf *bytes.Buffer, tables []*benchstat.Table, previous map[*benchstat.Row]string) error {
+	return renderTemplate.Execute(buf, markdownData{Tables: tables, Previous: previous})
+}
+
+// encodeResults returns the results of the new side of the tables in the
+// benchmark output format, so that they can be compared against on a later run.
+func encodeResults(tables []*benchstat.Table) string {
+	var b strings.Builder
+	for _, t := range tables {
+		for _, r := range t.Rows {
+			if len(r.Metrics) == 0 {
+				continue
+			}
+			// Only the mean is kept, to bound the size of the results regardless of the count.
+			m := r.Metrics[len(r.Metrics)-1]
+			fmt.Fprintf(&b, "Benchmark%s 1 %s %s\n", unmarkedName(r.Benchmark), strconv.FormatFloat(m.Mean, 'g', -1, 64), m.Unit)
+		}
+	}
+	return b.String()
+}
+
+// compareWithPrevious returns the delta of the new side of every row of the tables
+// against the previous results, as returned by encodeResults.
+// Rows without previous results are left out.
+func compareWithPrevious(previous string, tables []*benchstat.Table) map[*benchstat.Row]string {
+	c := &benchstat.Collection{
+		DeltaTest: benchstat.NoDeltaTest,
+	}
+	c.AddConfig("previous", []byte(previous))
+	c.AddConfig("current", []byte(encodeResults(tables)))
+
+	deltas := map[string]string{}
+	for _, t := range c.Tables() {
+		for _, r := range t.Rows {
+			deltas[t.Metric+"/"+r.Benchmark] = strings.TrimSpace(r.Delta + " " + r.Note)
+		}
+	}
+
+	res := map[*benchstat.Row]string{}
+	for _, t := range tables {
+		for _, r := range t.Rows {
+			if d, ok := deltas[t.Metric+"/"+unmarkedName(r.Benchmark)]; ok {
+				res[r] = d
+			}
+		}
+	}
+	return res
+}
+
+// jsonlComparison is the comparison of a single benchmark metric written by writeJSONL.
+type jsonlComparison struct {
+	Benchmark string        `json:"benchmark"`
+	Metric    string        `json:"metric"`
+	Old       *jsonlMetrics `json:"old,omitempty"`
+	New       *jsonlMetrics `json:"new,omitempty"`
+	Delta     string        `json:"delta,omitempty"`
+	PctDelta  float64       `json:"pct_delta"`
+	Note      string        `json:"note,omitempty"`
+}
+
+type jsonlMetrics struct {
+	Unit   string    `json:"unit"`
+	Mean   float64   `json:"mean"`
+	Values []float64 `json:"values"`
+}
+
+// streamJSONL writes the compared benchmark metrics as JSON lines to the file fn.
+// It's kept apart from stdout, which is shared with the logs and the benchmark output.
+func streamJSONL(fn string, tables []*benchstat.Table) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if err := writeJSONL(f, tables); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeJSONL writes a JSON object per compared benchmark metric to w, one per line.
+// The objects are written in the order of the tables and their rows, the same as rendered.
+func writeJSONL(w io.Writer, tables []*benchstat.Table) error {
+	enc := json.NewEncoder(w)
+	for _, t := range tables {
+		for _, r := range t.Rows {
+			c := jsonlComparison{
+				Benchmark: r.Benchmark,
+				Metric:    t.Metric,
+				Delta:     r.Delta,
+				PctDelta:  r.PctDelta,
+				Note:      r.Note,
+			}
+			if len(r.Metrics) == 2 {
+				c.Old = &jsonlMetrics{Unit: r.Metrics[0].Unit, Mean: r.Metrics[0].Mean, Values: r.Metrics[0].RValues}
+				c.New = &jsonlMetrics{Unit: r.Metrics[1].Unit, Mean: r.Metrics[1].Mean, Values: r.Metrics[1].RValues}
+			}
+			// Encode writes a newline after every object.
+			if err := enc.Encode(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// summarizeTables returns a line per table counting its benchmarks which got better, worse or didn't change.
+func summarizeTables(tables []*benchstat.Table) string {
+	var lines []string
+	for _, t := range tables {
+		if !t.OldNewDelta {
+			continue
+		}
+		var better, worse int
+		for _, r := range t.Rows {
+			switch {
+			case r.Change > 0:
+				better++
+			case r.Change < 0:
+				worse++
+			}
+		}
+		lines = append(lines, fmt.Sprintf("%s: %d better, %d worse, %d unchanged", t.Metric, better, worse, len(t.Rows)-better-worse))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatHTML renders the tables and notes as a self-contained HTML page.
+func formatHTML(buf *bytes.Buffer, tables []*benchstat.Table, notes ...string) error {
+	return renderHTMLTemplate.Execute(buf, struct {
+		Tables []*benchstat.Table
+		Notes  []string
+	}{tables, notes})
+}
+
+// render writes the tables followed by the notes to w in one of the text, markdown or html formats.
+func render(w io.Writer, format string, tables []*benchstat.Table, notes ...string) error {
+	var buf bytes.Buffer
+	switch format {
+	case "text":
+		benchstat.FormatText(&buf, tables)
+	case "markdown":
+		if err := formatMarkdown(&buf, tables); err != nil {
+			return err
+		}
+	case "html":
+		if err := formatHTML(&buf, tables, notes...); err != nil {
+			return err
+		}
+		// Notes are already part of the page.
+		notes = nil
+	default:
+		return errors.Errorf("unknown output format %q", format)
+	}
+	for _, n := range notes {
+		if n != "" {
+			buf.WriteString("\n" + n + "\n")
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// formatBenchmarkSetDiff returns notes about the added and removed benchmarks.
+func formatBenchmarkSetDiff(added, removed []string) []string {
+	var notes []string
+	if len(added) > 0 {
+		notes = append(notes, fmt.Sprintf("Added: [%s]", strings.Join(added, ", ")))
+	}
+	if len(removed) > 0 {
+		notes = append(notes, fmt.Sprintf("Removed: [%s]", strings.Join(removed, ", ")))
+	}
+	return notes
+}
+
+const (
+	noisyMarker = "⚠️"
+	shortMarker = "⏱️"
+)
+
+// unmarkedName returns the name of the benchmark without the markers added by markNoisyRows and markShortRows.
+// The markers can be added in any order.
+func unmarkedName(name string) string {
+	for {
+		unmarked := name
+		for _, m := range []string{noisyMarker, shortMarker} {
+			unmarked = strings.TrimPrefix(unmarked, m+" ")
+		}
+		if unmarked == name {
+			return name
+		}
+		name = unmarked
+	}
+}
+
+// markNoisyRows prefixes the name of every benchmark whose coefficient of variation exceeds
+// maxNoise percent with a warning marker, and returns a note to show along with the results.
+// The variance can only be assessed when each benchmark was run more than once.
+func markNoisyRows(tables []*benchstat.Table, maxNoise float64) string {
+	if maxNoise <= 0 {
+		return ""
+	}
+
+	noisy := map[string]struct{}{}
+	for _, t := range tables {
+		for _, r := range t.Rows {
+			for _, m := range r.Metrics {
+				if len(m.RValues) < 2 {
+					return "Note: Each benchmark ran only once, variance can't be assessed. Use --count to run them multiple times."
+				}
+				if coefficientOfVariation(m.RValues) > maxNoise {
+					noisy[r.Benchmark] = struct{}{}
+				}
+			}
+		}
+	}
+	if len(noisy) == 0 {
+		return ""
+	}
+
+	for _, t := range tables {
+		for _, r := range t.Rows {
+			if _, ok := noisy[r.Benchmark]; ok {
+				r.Benchmark = noisyMarker + " " + r.Benchmark
+			}
+		}
+	}
+	return fmt.Sprintf("%s %d benchmark(s) vary by more than %v%% between runs, their results are unreliable.", noisyMarker, len(noisy), maxNoise)
+}
+
+// timeUnits holds the units the time metrics can be formatted in, along with their value in nanoseconds.
+var timeUnits = map[string]float64{"ns": 1, "us": 1e3, "µs": 1e3, "ms": 1e6, "s": 1e9}
+
+// formatRows rounds the deltas of the tables to deltaPrecision decimal places. benchstat picks the unit of
+// the time metrics per row based on their magnitude, unless fixedUnit is set to one of the timeUnits.
+func formatRows(tables []*benchstat.Table, deltaPrecision int, fixedUnit string) error {
+	if deltaPrecision < 0 {
+		return errors.Errorf("negative delta precision %d", deltaPrecision)
+	}
+	var scaler benchstat.Scaler
+	if fixedUnit != "" {
+		scale, ok := timeUnits[fixedUnit]
+		if !ok {
+			return errors.Errorf("unknown time unit %q", fixedUnit)
+		}
+		if fixedUnit == "us" {
+			fixedUnit = "µs"
+		}
+		scaler = func(ns float64) string {
+			// Keep three significant digits like benchstat, without switching to the exponent notation.
+			format := "%.3g"
+			switch x := ns / scale; {
+			case x >= 99.5:
+				format = "%.0f"
+			case x >= 9.95:
+				format = "%.1f"
+			case x >= 0.995:
+				format = "%.2f"
+			}
+			return fmt.Sprintf(format+"%s", ns/scale, fixedUnit)
+		}
+	}
+
+	for _, t := range tables {
+		for _, r := range t.Rows {
+			if scaler != nil && len(r.Metrics) > 0 && strings.HasPrefix(r.Metrics[0].Unit, "ns/") {
+				r.Scaler = scaler
+			}
+			// Leave the deltas which aren't significant as they are.
+			if r.Delta == "~" {
+				continue
+			}
+			if r.PctDelta == 0 {
+				r.Delta = fmt.Sprintf("%.*f%%", deltaPrecision, 0.0)
+				continue
+			}
+			r.Delta = fmt.Sprintf("%+.*f%%", deltaPrecision, r.PctDelta)
+		}
+	}
+	return nil
+}
+
+// markShortRows prefixes the name of every benchmark taking less than minRuntime per op on either side
+// with a marker, and returns a note to show along with the results. The results of such benchmarks are
+// dominated by the overhead of the benchmark loop.
+func markShortRows(tables []*benchstat.Table, minRuntime time.Duration) string {
+	if minRuntime <= 0 {
+		return ""
+	}
+
+	short := map[string]struct{}{}
+	for _, t := range tables {
+		for _, r := range t.Rows {
+			for _, m := range r.Metrics {
+				if m.Unit == "ns/op" && m.Mean < float64(minRuntime.Nanoseconds()) {
+					short[r.Benchmark] = struct{}{}
+				}
+			}
+		}
+	}
+	if len(short) == 0 {
+		return ""
+	}
+
+	for _, t := range tables {
+		for _, r := range t.Rows {
+			if _, ok := short[r.Benchmark]; ok {
+				r.Benchmark = shortMarker + " " + r.Benchmark
+			}
+		}
+	}
+	return fmt.Sprintf("%s %d benchmark(s) take less than %v per op, their results are likely dominated by the benchmark loop overhead. "+
+		"Make them do more work per op, or raise --bench-time or --count.", shortMarker, len(short), minRuntime)
+}
+
+// coefficientOfVariation returns the standard deviation of the values as a percentage of their mean.
+func coefficientOfVariation(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	if mean == 0 {
+		return 0
+	}
+
+	var sqDiff float64
+	for _, v := range values {
+		sqDiff += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(sqDiff/float64(len(values)-1)) / math.Abs(mean) * 100
 }
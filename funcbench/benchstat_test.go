@@ -14,10 +14,14 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/perf/benchstat"
 )
@@ -97,3 +101,412 @@ BenchmarkIsolation/100-8	39044	28747 ns/op	6 B/op	0 allocs/op
 		t.Error("Should return an error indicated that no matching benchmarks found.")
 	}
 }
+
+func TestCompareBenchmarksUnparsedOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_unparsed_output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var panicOut strings.Builder
+	panicOut.WriteString("goos: linux\npanic: runtime error: index out of range [3] with length 3\n\ngoroutine 1 [running]:\n")
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&panicOut, "github.com/prometheus/prometheus/tsdb.frame%d()\n", i)
+	}
+
+	files := map[string]string{
+		"old": "BenchmarkRespond-4	710	1691189 ns/op\nPASS\nok  	github.com/prometheus/prometheus/web/api/v1	2.431s\n",
+		"new": panicOut.String(),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = compareBenchmarks(filepath.Join(dir, "old"), filepath.Join(dir, "new"))
+	if err == nil {
+		t.Fatal("Expected an error for output without parsable benchmark results")
+	}
+	for _, expected := range []string{"no benchmark results could be parsed from " + filepath.Join(dir, "new"), "panic: runtime error", "... (14 more lines)"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q in the error, got:\n%v", expected, err)
+		}
+	}
+}
+
+func TestCompareSubBenchmarks(t *testing.T) {
+	result := `
+goos: linux
+BenchmarkPostings/size=small/op=read-8	1000	1000 ns/op	10 B/op	1 allocs/op
+BenchmarkPostings/size=small/op=write-8	1000	2000 ns/op	20 B/op	2 allocs/op
+BenchmarkPostings/size=medium/op=read-8	1000	3000 ns/op	30 B/op	3 allocs/op
+BenchmarkPostings/size=large/op=read-8	1000	4000 ns/op	40 B/op	4 allocs/op
+BenchmarkPostings/size=large/op=write-8	1000	8000 ns/op	80 B/op	8 allocs/op
+PASS
+`
+	dir, err := ioutil.TempDir("", "test_sub_benchmarks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := filepath.Join(dir, "result")
+	if err := ioutil.WriteFile(f, []byte(result), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Benchmarker{oldSubBenchmark: "size=small", newSubBenchmark: "size=large"}
+	tables, err := b.compareSubBenchmarks(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := formatMarkdown(&buf, tables[:1]); err != nil {
+		t.Fatal(err)
+	}
+	expected := `Benchmark|Old time/op|New time/op|Delta
+-|-|-|-
+Postings/op=read-8|1.00µs ± 0%|4.00µs ± 0%|+300.00% 
+Postings/op=write-8|2.00µs ± 0%|8.00µs ± 0%|+300.00%`
+	if out := strings.TrimSpace(buf.String()); out != expected {
+		t.Errorf("Expected:\n%s, but got:\n%s", expected, out)
+	}
+
+	b.newSubBenchmark = "size=huge"
+	if _, err := b.compareSubBenchmarks(f); err == nil || !strings.Contains(err.Error(), "size=huge") {
+		t.Errorf("Should return an error for a sub-benchmark pattern matching nothing, got %v", err)
+	}
+}
+
+func TestCompareSubBenchmarksBy(t *testing.T) {
+	result := `
+goos: linux
+BenchmarkAppend/series=100/samples=10-8	1000	1000 ns/op
+BenchmarkAppend/series=100/samples=100-8	1000	3000 ns/op
+BenchmarkAppend/series=1000/samples=10-8	1000	2000 ns/op
+BenchmarkAppend/series=1000/samples=100-8	1000	8000 ns/op
+PASS
+`
+	dir, err := ioutil.TempDir("", "test_sub_benchmarks_by")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := filepath.Join(dir, "result")
+	if err := ioutil.WriteFile(f, []byte(result), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Benchmarker{subBenchmarkBy: "samples"}
+	tables, err := b.compareSubBenchmarks(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 2 {
+		t.Fatalf("Expected a table for each series, got %d", len(tables))
+	}
+
+	var buf bytes.Buffer
+	if err := formatMarkdown(&buf, tables); err != nil {
+		t.Fatal(err)
+	}
+	expected := `Benchmark|Old time/op|New time/op|Delta
+-|-|-|-
+Append/series=100-8|1.00µs ± 0%|3.00µs ± 0%|+200.00% 
+
+Benchmark|Old time/op|New time/op|Delta
+-|-|-|-
+Append/series=1000-8|2.00µs ± 0%|8.00µs ± 0%|+300.00%`
+	if out := strings.TrimSpace(buf.String()); out != expected {
+		t.Errorf("Expected:\n%s, but got:\n%s", expected, out)
+	}
+
+	// More than two values are shown as columns, without a delta.
+	result += `BenchmarkAppend/series=100/samples=1000-8	100	20000 ns/op
+BenchmarkAppend/series=1000/samples=1000-8	100	50000 ns/op
+`
+	if err := ioutil.WriteFile(f, []byte(result), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if tables, err = b.compareSubBenchmarks(f); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := formatMarkdown(&buf, tables); err != nil {
+		t.Fatal(err)
+	}
+	expected = `Benchmark|samples=10 time/op|samples=100 time/op|samples=1000 time/op
+-|-|-|-
+Append/series=100-8|1.00µs ± 0%|3.00µs ± 0%|20.00µs ± 0%
+
+Benchmark|samples=10 time/op|samples=100 time/op|samples=1000 time/op
+-|-|-|-
+Append/series=1000-8|2.00µs ± 0%|8.00µs ± 0%|50.00µs ± 0%`
+	if out := strings.TrimSpace(buf.String()); out != expected {
+		t.Errorf("Expected:\n%s, but got:\n%s", expected, out)
+	}
+
+	b.subBenchmarkBy = "chunks"
+	if _, err := b.compareSubBenchmarks(f); err == nil || !strings.Contains(err.Error(), "is not present") {
+		t.Errorf("Should return an error for a missing sub-benchmark dimension, got %v", err)
+	}
+
+	b = &Benchmarker{subBenchmarkBy: "samples", oldSubBenchmark: "samples=10"}
+	if _, err := b.compareSubBenchmarks(f); err == nil {
+		t.Error("Should return an error when combined with old and new sub-benchmark patterns")
+	}
+}
+
+func TestMarkNoisyRows(t *testing.T) {
+	file1 := `BenchmarkStable-4	1000	1000 ns/op
+BenchmarkStable-4	1000	1010 ns/op
+BenchmarkStable-4	1000	990 ns/op
+BenchmarkNoisy-4	1000	1000 ns/op
+BenchmarkNoisy-4	1000	1500 ns/op
+BenchmarkNoisy-4	1000	700 ns/op`
+	file2 := `BenchmarkStable-4	1000	1000 ns/op
+BenchmarkStable-4	1000	1000 ns/op
+BenchmarkStable-4	1000	1005 ns/op
+BenchmarkNoisy-4	1000	1000 ns/op
+BenchmarkNoisy-4	1000	1005 ns/op
+BenchmarkNoisy-4	1000	995 ns/op`
+
+	c := &benchstat.Collection{}
+	c.AddConfig("file1", []byte(file1))
+	c.AddConfig("file2", []byte(file2))
+	tables := c.Tables()
+
+	note := markNoisyRows(tables, 5)
+	if !strings.Contains(note, "1 benchmark(s)") {
+		t.Errorf("Expected a note about one noisy benchmark, got %q", note)
+	}
+	for _, r := range tables[0].Rows {
+		marked := strings.HasPrefix(r.Benchmark, noisyMarker)
+		if strings.HasSuffix(r.Benchmark, "Noisy-4") != marked {
+			t.Errorf("Unexpected noise marking for %q", r.Benchmark)
+		}
+	}
+
+	c = &benchstat.Collection{}
+	c.AddConfig("file1", []byte("BenchmarkStable-4	1000	1000 ns/op"))
+	c.AddConfig("file2", []byte("BenchmarkStable-4	1000	1500 ns/op"))
+	if note := markNoisyRows(c.Tables(), 5); !strings.Contains(note, "can't be assessed") {
+		t.Errorf("Expected a note that variance can't be assessed, got %q", note)
+	}
+}
+
+func TestMarkShortRows(t *testing.T) {
+	c := &benchstat.Collection{DeltaTest: benchstat.NoDeltaTest}
+	c.AddConfig("old", []byte("BenchmarkFast-4	1000000000	0.37 ns/op	0 B/op\nBenchmarkParse-4	510378	2388 ns/op	1024 B/op"))
+	c.AddConfig("new", []byte("BenchmarkFast-4	1000000000	1.2 ns/op	0 B/op\nBenchmarkParse-4	434798	2374 ns/op	1024 B/op"))
+	tables := c.Tables()
+
+	note := markShortRows(tables, time.Nanosecond)
+	if !strings.HasPrefix(note, shortMarker+" 1 benchmark(s) take less than 1ns per op") {
+		t.Errorf("Expected a note about one too short benchmark, got %q", note)
+	}
+	for _, table := range tables {
+		for _, r := range table.Rows {
+			marked := strings.HasPrefix(r.Benchmark, shortMarker+" ")
+			if strings.HasSuffix(r.Benchmark, "Fast-4") != marked {
+				t.Errorf("Unexpected marking for %q in %s", r.Benchmark, table.Metric)
+			}
+			if unmarkedName(r.Benchmark) == r.Benchmark && marked {
+				t.Errorf("Expected the marker to be stripped from %q", r.Benchmark)
+			}
+		}
+	}
+
+	if note := markShortRows(c.Tables(), 0); note != "" {
+		t.Errorf("Expected no note with the check disabled, got %q", note)
+	}
+}
+
+func TestUnmarkedName(t *testing.T) {
+	for _, name := range []string{
+		"Foo-4",
+		noisyMarker + " Foo-4",
+		shortMarker + " Foo-4",
+		noisyMarker + " " + shortMarker + " Foo-4",
+		shortMarker + " " + noisyMarker + " Foo-4",
+	} {
+		if got := unmarkedName(name); got != "Foo-4" {
+			t.Errorf("Expected %q to be unmarked to Foo-4, got %q", name, got)
+		}
+	}
+}
+
+func TestFormatHTML(t *testing.T) {
+	file1 := `BenchmarkRespond-4	710	1691189 ns/op
+BenchmarkRespond-4	710	1691189 ns/op
+BenchmarkRespond-4	710	1691189 ns/op
+BenchmarkQuery/expr=<a&b>-4	2310	457700 ns/op
+BenchmarkQuery/expr=<a&b>-4	2310	457700 ns/op
+BenchmarkQuery/expr=<a&b>-4	2310	457700 ns/op`
+	file2 := `BenchmarkRespond-4	688	1751880 ns/op
+BenchmarkRespond-4	688	1751880 ns/op
+BenchmarkRespond-4	688	1751880 ns/op
+BenchmarkQuery/expr=<a&b>-4	2553	356152 ns/op
+BenchmarkQuery/expr=<a&b>-4	2553	356152 ns/op
+BenchmarkQuery/expr=<a&b>-4	2553	356152 ns/op`
+	c := &benchstat.Collection{DeltaTest: benchstat.NoDeltaTest}
+	c.AddConfig("file1", []byte(file1))
+	c.AddConfig("file2", []byte(file2))
+
+	var buf bytes.Buffer
+	if err := render(&buf, "html", c.Tables()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := ioutil.ReadFile(filepath.Join("testdata", "report.html.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != string(expected) {
+		t.Errorf("Expected:\n%s, but got:\n%s", expected, buf.String())
+	}
+}
+
+func TestStreamJSONL(t *testing.T) {
+	c := &benchstat.Collection{DeltaTest: benchstat.NoDeltaTest}
+	c.AddConfig("old", []byte("BenchmarkRespond-4	710	1691189 ns/op	4096 B/op\nBenchmarkParse-4	510378	2388 ns/op	1024 B/op"))
+	c.AddConfig("new", []byte("BenchmarkRespond-4	688	1500000 ns/op	4096 B/op\nBenchmarkParse-4	434798	2374 ns/op	1024 B/op"))
+
+	dir, err := ioutil.TempDir("", "test_jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "results.jsonl")
+	if err := streamJSONL(fn, c.Tables()); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`{"benchmark":"Respond-4","metric":"time/op","old":{"unit":"ns/op","mean":1691189,"values":[1691189]},"new":{"unit":"ns/op","mean":1500000,"values":[1500000]},"delta":"-11.31%","pct_delta":-11.305004940311225}`,
+		`{"benchmark":"Parse-4","metric":"time/op","old":{"unit":"ns/op","mean":2388,"values":[2388]},"new":{"unit":"ns/op","mean":2374,"values":[2374]},"delta":"-0.59%","pct_delta":-0.5862646566164198}`,
+		`{"benchmark":"Respond-4","metric":"alloc/op","old":{"unit":"B/op","mean":4096,"values":[4096]},"new":{"unit":"B/op","mean":4096,"values":[4096]},"delta":"0.00%","pct_delta":0}`,
+		`{"benchmark":"Parse-4","metric":"alloc/op","old":{"unit":"B/op","mean":1024,"values":[1024]},"new":{"unit":"B/op","mean":1024,"values":[1024]},"delta":"0.00%","pct_delta":0}`,
+	}
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	if !reflect.DeepEqual(expected, lines) {
+		t.Errorf("Expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
+
+func TestFormatRows(t *testing.T) {
+	oldResult := `BenchmarkFast-4	1000000000	0.372 ns/op	0 B/op
+BenchmarkFast-4	1000000000	0.371 ns/op	0 B/op
+BenchmarkFast-4	1000000000	0.373 ns/op	0 B/op
+BenchmarkParse-4	510378	2388 ns/op	1024 B/op
+BenchmarkParse-4	510378	2391 ns/op	1024 B/op
+BenchmarkParse-4	510378	2390 ns/op	1024 B/op
+BenchmarkRespond-4	710	1691189 ns/op	4096 B/op
+BenchmarkRespond-4	710	1690189 ns/op	4096 B/op
+BenchmarkRespond-4	710	1692189 ns/op	4096 B/op`
+	newResult := `BenchmarkFast-4	1000000000	0.351 ns/op	0 B/op
+BenchmarkFast-4	1000000000	0.352 ns/op	0 B/op
+BenchmarkFast-4	1000000000	0.350 ns/op	0 B/op
+BenchmarkParse-4	434798	2374 ns/op	1024 B/op
+BenchmarkParse-4	434798	2371 ns/op	1024 B/op
+BenchmarkParse-4	434798	2373 ns/op	1024 B/op
+BenchmarkRespond-4	688	1751880 ns/op	4608 B/op
+BenchmarkRespond-4	688	1752880 ns/op	4608 B/op
+BenchmarkRespond-4	688	1750880 ns/op	4608 B/op`
+
+	for _, tcase := range []struct {
+		golden         string
+		deltaPrecision int
+		fixedUnit      string
+	}{
+		{golden: "report.md.golden", deltaPrecision: 2},
+		{golden: "report_fixed_unit.md.golden", deltaPrecision: 1, fixedUnit: "us"},
+	} {
+		t.Run(tcase.golden, func(t *testing.T) {
+			c := &benchstat.Collection{DeltaTest: benchstat.TTest}
+			c.AddConfig("old", []byte(oldResult))
+			c.AddConfig("new", []byte(newResult))
+			tables := c.Tables()
+			if err := formatRows(tables, tcase.deltaPrecision, tcase.fixedUnit); err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			if err := render(&buf, "markdown", tables); err != nil {
+				t.Fatal(err)
+			}
+
+			expected, err := ioutil.ReadFile(filepath.Join("testdata", tcase.golden))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != string(expected) {
+				t.Errorf("Expected:\n%s, but got:\n%s", expected, buf.String())
+			}
+		})
+	}
+
+	if err := formatRows(nil, 2, "weeks"); err == nil {
+		t.Error("Expected error for an unknown time unit")
+	}
+}
+
+func TestDiffBenchmarkSets(t *testing.T) {
+	oldResult := `BenchmarkRespond-4	710	1691189 ns/op
+BenchmarkQueryOld-4	2310	457700 ns/op
+BenchmarkParse-4	510378	2388 ns/op`
+	newResult := `BenchmarkRespond-4	688	1751880 ns/op
+BenchmarkParse-4	434798	2374 ns/op
+BenchmarkQueryNew-4	2553	456152 ns/op`
+
+	dir, err := ioutil.TempDir("", "test_diff_benchmark_sets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldFile, newFile := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+	if err := ioutil.WriteFile(oldFile, []byte(oldResult), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(newFile, []byte(newResult), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	added, removed, err := diffBenchmarkSets(oldFile, newFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(added, []string{"QueryNew-4"}) {
+		t.Errorf("Expected QueryNew-4 to be added, got %v", added)
+	}
+	if !reflect.DeepEqual(removed, []string{"QueryOld-4"}) {
+		t.Errorf("Expected QueryOld-4 to be removed, got %v", removed)
+	}
+
+	if _, _, err := compareResults(oldFile, newFile, true); err == nil || !strings.Contains(err.Error(), "Added: [QueryNew-4]\nRemoved: [QueryOld-4]") {
+		t.Errorf("Expected an error listing the benchmarks present on one side with parity required, got %v", err)
+	}
+
+	tables, info, err := compareResults(oldFile, newFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := render(&buf, "markdown", tables, info...); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "Added: [QueryNew-4]") || !strings.Contains(out, "Removed: [QueryOld-4]") {
+		t.Errorf("Expected added and removed benchmarks in the output, got:\n%s", out)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultConfigFile = ".funcbench.yaml"
+
+// configFile returns the config file passed with --config in args,
+// otherwise defaultConfigFile and false.
+func configFile(args []string) (string, bool) {
+	for i, arg := range args {
+		switch {
+		case arg == "--":
+			return defaultConfigFile, false
+		case arg == "--config" && i+1 < len(args):
+			return args[i+1], true
+		case strings.HasPrefix(arg, "--config="):
+			return strings.TrimPrefix(arg, "--config="), true
+		}
+	}
+	return defaultConfigFile, false
+}
+
+// applyConfigFile sets the values of the config file as the defaults of the app flags,
+// so that flags passed on the command line take precedence over them.
+// The config file maps long flag names to a value, or a list of values for repeatable flags.
+// A missing config file is only an error when it was explicitly requested.
+// It returns the names of the flags set by the config file, as their actions
+// only run for flags passed on the command line.
+func applyConfigFile(app *kingpin.Application, file string, required bool) (map[string]bool, error) {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) && !required {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := map[string]interface{}{}
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, errors.Wrapf(err, "parse config file %s", file)
+	}
+
+	set := make(map[string]bool, len(cfg))
+	for name, v := range cfg {
+		flag := app.GetFlag(name)
+		if flag == nil {
+			return nil, errors.Errorf("unknown flag %q in config file %s", name, file)
+		}
+
+		var values []string
+		switch v := v.(type) {
+		case []interface{}:
+			for _, e := range v {
+				values = append(values, fmt.Sprint(e))
+			}
+		default:
+			values = []string{fmt.Sprint(v)}
+		}
+		flag.Default(values...)
+		set[name] = true
+	}
+	return set, nil
+}
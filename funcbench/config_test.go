@@ -0,0 +1,103 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestApplyConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_config_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "funcbench.yaml")
+	config := `
+owner: prometheus-community
+repo: node_exporter
+count: 5
+bench-time: 10s
+package:
+  - ./tsdb
+  - ./promql
+show-env: false
+`
+	if err := ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := struct {
+		owner     string
+		repo      string
+		count     int
+		benchTime time.Duration
+		packages  []string
+		nocomment bool
+		showEnv   bool
+	}{}
+	app := kingpin.New("funcbench", "")
+	app.Flag("owner", "").Default("prometheus").StringVar(&cfg.owner)
+	app.Flag("repo", "").Default("prometheus").StringVar(&cfg.repo)
+	app.Flag("count", "").Default("1").IntVar(&cfg.count)
+	app.Flag("bench-time", "").Default("1s").DurationVar(&cfg.benchTime)
+	app.Flag("package", "").StringsVar(&cfg.packages)
+	app.Flag("nocomment", "").BoolVar(&cfg.nocomment)
+	app.Flag("show-env", "").BoolVar(&cfg.showEnv)
+	app.Flag("config", "").Default(defaultConfigFile).String()
+
+	args := []string{"--config", file, "--repo=prometheus"}
+	f, explicit := configFile(args)
+	if f != file || !explicit {
+		t.Fatalf("Expected config file %s, got %s", file, f)
+	}
+	configured, err := applyConfigFile(app, f, explicit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !configured["show-env"] || !configured["package"] || configured["nocomment"] {
+		t.Errorf("Expected the flags set by the config file, got %v", configured)
+	}
+	if _, err := app.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.owner != "prometheus-community" || cfg.count != 5 || cfg.benchTime != 10*time.Second {
+		t.Errorf("Expected config file values for unset flags, got %+v", cfg)
+	}
+	if !reflect.DeepEqual(cfg.packages, []string{"./tsdb", "./promql"}) {
+		t.Errorf("Expected packages from the config file, got %v", cfg.packages)
+	}
+	if cfg.repo != "prometheus" {
+		t.Errorf("Expected the command line to take precedence over the config file, got %s", cfg.repo)
+	}
+	if cfg.nocomment {
+		t.Errorf("Expected built-in default for flags missing in the config file")
+	}
+
+	if _, err := applyConfigFile(app, filepath.Join(dir, "missing.yaml"), false); err != nil {
+		t.Errorf("Expected a missing default config file to be ignored, got %v", err)
+	}
+	if _, err := applyConfigFile(app, filepath.Join(dir, "missing.yaml"), true); err == nil {
+		t.Errorf("Expected an error for a missing explicit config file")
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
@@ -33,7 +34,10 @@ import (
 type Environment interface {
 	BenchFunc() string
 	CompareTarget() string
+	TargetRemote() string
+	SetCompareTarget(compareTarget string)
 	SetHashStrings(compareTargetHash, repoHeadHashString string)
+	SetSubjects(compareTargetSubject, repoHeadSubject string)
 
 	PostErr(err string) error
 	PostResults(tables []*benchstat.Table, extraInfo ...string) error
@@ -46,16 +50,49 @@ type environment struct {
 
 	benchFunc               string
 	compareTarget           string
+	targetRemote            string
 	compareTargetHashString string
 	repoHeadHashString      string
+	compareTargetSubject    string
+	repoHeadSubject         string
 }
 
 func (e environment) BenchFunc() string     { return e.benchFunc }
 func (e environment) CompareTarget() string { return e.compareTarget }
+func (e environment) TargetRemote() string  { return e.targetRemote }
+func (e *environment) SetCompareTarget(compareTarget string) {
+	e.compareTarget = compareTarget
+}
 func (e *environment) SetHashStrings(compareTargetHash, repoHeadHashString string) {
 	e.compareTargetHashString = compareTargetHash
 	e.repoHeadHashString = repoHeadHashString
 }
+func (e *environment) SetSubjects(compareTargetSubject, repoHeadSubject string) {
+	e.compareTargetSubject = compareTargetSubject
+	e.repoHeadSubject = repoHeadSubject
+}
+
+// subject returns the commit subject to show along with its hash.
+func subject(s string) string {
+	if s == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", s)
+}
+
+// baseTarget is the compare target standing for the base branch of the PR in GitHub mode
+// and for the default branch of the repository in local mode.
+const baseTarget = "base"
+
+// defaultBranch returns the default branch of the repository, as set by refs/remotes/origin/HEAD.
+func defaultBranch(r *git.Repository) (string, error) {
+	ref, err := r.Reference(plumbing.NewRemoteHEADReferenceName("origin"), false)
+	if err != nil || ref.Type() != plumbing.SymbolicReference {
+		return "", errors.Errorf("can't determine the default branch from %s, "+
+			"set it with 'git remote set-head origin --auto' or pass the target explicitly", plumbing.NewRemoteHEADReferenceName("origin"))
+	}
+	return ref.Target().Short(), nil
+}
 
 type Local struct {
 	environment
@@ -68,6 +105,12 @@ func newLocalEnv(e environment) (Environment, error) {
 	if err != nil {
 		return nil, err
 	}
+	// The default branch of a target remote is only known once it's fetched.
+	if e.compareTarget == baseTarget && e.targetRemote == "" {
+		if e.compareTarget, err = defaultBranch(r); err != nil {
+			return nil, err
+		}
+	}
 	e.logger.Println("[Local Mode]", "\nBenchmarking current version versus:", e.compareTarget, "\nBenchmark func regex:", e.benchFunc)
 	return &Local{environment: e, repo: r}, nil
 }
@@ -75,9 +118,11 @@ func newLocalEnv(e environment) (Environment, error) {
 func (l *Local) PostErr(string) error { return nil } // Noop. We will see error anyway.
 
 func (l *Local) PostResults(tables []*benchstat.Table, extraInfo ...string) error {
-	legend := fmt.Sprintf("Old: %s\nNew: %s",
+	legend := fmt.Sprintf("Old: %s%s\nNew: %s%s",
 		l.compareTargetHashString,
+		subject(l.compareTargetSubject),
 		l.repoHeadHashString,
+		subject(l.repoHeadSubject),
 	)
 	fmt.Printf("Results:\n%s\n", legend)
 
@@ -86,6 +131,12 @@ func (l *Local) PostResults(tables []*benchstat.Table, extraInfo ...string) erro
 
 	os.Stdout.Write(buf.Bytes())
 
+	for _, info := range extraInfo {
+		if info != "" {
+			fmt.Println(info)
+		}
+	}
+
 	return nil
 }
 
@@ -160,7 +211,16 @@ func newGitHubEnv(ctx context.Context, e environment, gc *gitHubClient, workspac
 		return nil, errors.Wrap(err, "switch to pull request branch")
 	}
 
-	e.logger.Println("[GitHub Mode]", gc.owner, ":", gc.repo, "\nBenchmarking PR -", gc.prNumber, "versus:", e.compareTarget, "\nBenchmark func regex:", e.benchFunc)
+	if e.compareTarget == baseTarget {
+		base, err := gc.baseRef()
+		if err != nil {
+			return nil, errors.Wrap(err, "get base branch of the pull request")
+		}
+		// Base branches other than the default one are only fetched as remote branches.
+		g.compareTarget = "origin/" + base
+	}
+
+	e.logger.Println("[GitHub Mode]", gc.owner, ":", gc.repo, "\nBenchmarking PR -", gc.prNumber, "versus:", g.compareTarget, "\nBenchmark func regex:", e.benchFunc)
 	return g, nil
 }
 
@@ -172,7 +232,8 @@ func (g *GitHub) PostErr(txt string) error {
 		txt,
 	)
 
-	if err := g.client.postComment(c); err != nil {
+	// Errors don't replace the results of a previous run.
+	if err := g.client.postComment(errorCommentMarker, c); err != nil {
 		return err
 	}
 
@@ -180,24 +241,75 @@ func (g *GitHub) PostErr(txt string) error {
 }
 
 func (g *GitHub) PostResults(tables []*benchstat.Table, extraInfo ...string) error {
+	previous, err := g.client.previousResults()
+	if err != nil {
+		return errors.Wrap(err, "get results of the previous run")
+	}
+
 	b := bytes.Buffer{}
-	if err := formatMarkdown(&b, tables); err != nil {
+	if previous == "" {
+		err = formatMarkdown(&b, tables)
+	} else {
+		err = formatMarkdownWithPrevious(&b, tables, compareWithPrevious(previous, tables))
+	}
+	if err != nil {
 		return err
 	}
 
-	legend := fmt.Sprintf("Old: `%v`/`%v`\nNew: `PR-%v`/`%v`",
+	legend := fmt.Sprintf("Old: `%v`/`%v`%v\nNew: `PR-%v`/`%v`%v",
 		g.compareTarget,
 		g.compareTargetHashString,
+		subject(g.compareTargetSubject),
 		g.client.prNumber,
 		g.repoHeadHashString,
+		subject(g.repoHeadSubject),
 	)
-	result := fmt.Sprintf(
-		"<details><summary>Click to check benchmark result</summary>\n\n%s\n%s\n%s</details>",
-		legend,
-		strings.Join(extraInfo, "\n"),
-		b.String(),
-	)
-	return g.client.postComment(result)
+	report := fmt.Sprintf("%s\n%s\n%s", legend, strings.Join(extraInfo, "\n"), b.String())
+	if err := writeStepSummary(report); err != nil {
+		g.logger.Println("Failed to write the job summary:", err)
+	}
+
+	details := fmt.Sprintf("<details><summary>Click to check benchmark result</summary>\n\n%s</details>", report)
+	if g.client.resultsToGist {
+		gistURL, err := g.client.createGist(report)
+		if err != nil {
+			g.logger.Println("Failed to upload the results to a gist, posting them in the comment instead:", err)
+		} else {
+			details = fmt.Sprintf("%s\n%s\nFull results: %s", legend, summarizeTables(tables), gistURL)
+		}
+	}
+	comment, ok := withResultsData(details, tables)
+	if !ok {
+		g.logger.Println("Results are too large to be kept in the comment, the next run won't be compared against them.")
+	}
+	if err := g.client.postComment(commentMarker, comment); err != nil {
+		return err
+	}
+	// The error of a previous run is stale along with the new results.
+	if err := g.client.deleteComment(errorCommentMarker); err != nil {
+		g.logger.Println("Failed to delete the error comment of a previous run:", err)
+	}
+	return nil
+}
+
+// writeStepSummary appends the summary to the GitHub Actions job summary
+// when running in GitHub Actions, otherwise it is a noop.
+func writeStepSummary(summary string) error {
+	fileName, ok := os.LookupEnv("GITHUB_STEP_SUMMARY")
+	if !ok || fileName == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(summary + "\n"); err != nil {
+		return err
+	}
+	return f.Close()
 }
 
 func (g *GitHub) Repo() *git.Repository { return g.repo }
@@ -209,9 +321,16 @@ type gitHubClient struct {
 	client    *github.Client
 	nocomment bool
 	ctx       context.Context
+
+	// resultsToGist uploads the results to a gist and only links them in the comment.
+	resultsToGist bool
+	// commentURL is the URL of the last posted comment.
+	commentURL string
+	// login of the authenticated user, to find the comments posted by funcbench.
+	login string
 }
 
-func newGitHubClient(ctx context.Context, owner, repo string, prNumber int, nocomment bool) (*gitHubClient, error) {
+func newGitHubClient(ctx context.Context, owner, repo string, prNumber int, nocomment, resultsToGist bool) (*gitHubClient, error) {
 	ghToken, ok := os.LookupEnv("GITHUB_TOKEN")
 	if !ok && !nocomment {
 		return nil, fmt.Errorf("GITHUB_TOKEN missing")
@@ -225,16 +344,152 @@ func newGitHubClient(ctx context.Context, owner, repo string, prNumber int, noco
 		prNumber:  prNumber,
 		nocomment: nocomment,
 		ctx:       ctx,
+
+		resultsToGist: resultsToGist,
 	}
 	return &c, nil
 }
 
-func (c *gitHubClient) postComment(comment string) error {
+// baseRef returns the name of the branch the pull request targets.
+func (c *gitHubClient) baseRef() (string, error) {
+	pr, _, err := c.client.PullRequests.Get(c.ctx, c.owner, c.repo, c.prNumber)
+	if err != nil {
+		return "", err
+	}
+	if pr.GetBase().GetRef() == "" {
+		return "", errors.New("pull request has no base branch")
+	}
+	return pr.GetBase().GetRef(), nil
+}
+
+// createGist uploads the results to a secret gist and returns its URL.
+func (c *gitHubClient) createGist(results string) (string, error) {
+	gist, _, err := c.client.Gists.Create(c.ctx, &github.Gist{
+		Description: github.String(fmt.Sprintf("funcbench results of %s/%s#%d", c.owner, c.repo, c.prNumber)),
+		Public:      github.Bool(false),
+		Files: map[github.GistFilename]github.GistFile{
+			"funcbench.md": {Content: github.String(results)},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if gist.GetHTMLURL() == "" {
+		return "", errors.New("created gist has no URL")
+	}
+	return gist.GetHTMLURL(), nil
+}
+
+// commentMarker is a hidden marker identifying the comment posted by funcbench.
+const commentMarker = "<!-- funcbench-results -->"
+
+// errorCommentMarker is a hidden marker identifying the comment posted by funcbench
+// when a run failed.
+const errorCommentMarker = "<!-- funcbench-error -->"
+
+// resultsDataMarker starts a hidden block of the comment holding the results
+// of the run, to compare the next run of the same PR against.
+const resultsDataMarker = "<!-- funcbench-results-data"
+
+// maxCommentLength is the maximum length of the body of a GitHub comment.
+const maxCommentLength = 65536
+
+var resultsDataRe = regexp.MustCompile(`(?s)` + resultsDataMarker + `\n(.*?)-->`)
+
+// withResultsData appends the hidden block with the results to the comment, unless
+// it would exceed the maximum length of a comment. It returns whether the block was appended.
+func withResultsData(comment string, tables []*benchstat.Table) (string, bool) {
+	data := fmt.Sprintf("\n%s\n%s-->", resultsDataMarker, encodeResults(tables))
+	if len(commentMarker)+1+len(comment)+len(data) > maxCommentLength {
+		return comment, false
+	}
+	return comment + data, true
+}
+
+// previousResults returns the results of the previous run posted in the comment
+// of funcbench, empty if there is none.
+func (c *gitHubClient) previousResults() (string, error) {
+	if c.nocomment {
+		return "", nil
+	}
+	comment, err := c.findComment(commentMarker)
+	if err != nil {
+		return "", err
+	}
+	m := resultsDataRe.FindStringSubmatch(comment.GetBody())
+	if m == nil {
+		return "", nil
+	}
+	return m[1], nil
+}
+
+// postComment updates the comment with the marker posted by funcbench on a previous run
+// or creates a new one if there is none.
+func (c *gitHubClient) postComment(marker, comment string) error {
 	if c.nocomment {
 		return nil
 	}
 
-	issueComment := &github.IssueComment{Body: github.String(comment)}
-	_, _, err := c.client.Issues.CreateComment(c.ctx, c.owner, c.repo, c.prNumber, issueComment)
+	issueComment := &github.IssueComment{Body: github.String(marker + "\n" + comment)}
+
+	previous, err := c.findComment(marker)
+	if err != nil {
+		return errors.Wrap(err, "find previous comment")
+	}
+	var posted *github.IssueComment
+	if previous != nil {
+		posted, _, err = c.client.Issues.EditComment(c.ctx, c.owner, c.repo, previous.GetID(), issueComment)
+	} else {
+		posted, _, err = c.client.Issues.CreateComment(c.ctx, c.owner, c.repo, c.prNumber, issueComment)
+	}
+	if err != nil {
+		return err
+	}
+	c.commentURL = posted.GetHTMLURL()
+	return nil
+}
+
+// deleteComment deletes the comment with the marker posted by funcbench on a previous run, if any.
+func (c *gitHubClient) deleteComment(marker string) error {
+	if c.nocomment {
+		return nil
+	}
+	comment, err := c.findComment(marker)
+	if err != nil || comment == nil {
+		return err
+	}
+	_, err = c.client.Issues.DeleteComment(c.ctx, c.owner, c.repo, comment.GetID())
 	return err
 }
+
+// githubActionsLogin is the login of the user posting with the token of a GitHub Actions workflow.
+const githubActionsLogin = "github-actions[bot]"
+
+// findComment returns the comment containing the marker posted by the authenticated user,
+// nil if there is none.
+func (c *gitHubClient) findComment(marker string) (*github.IssueComment, error) {
+	if c.login == "" {
+		c.login = githubActionsLogin
+		// Installation tokens, eg. of GitHub Actions, can't get the authenticated user.
+		if user, _, err := c.client.Users.Get(c.ctx, ""); err == nil {
+			c.login = user.GetLogin()
+		}
+	}
+
+	opts := &github.IssueListCommentsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		comments, resp, err := c.client.Issues.ListComments(c.ctx, c.owner, c.repo, c.prNumber, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, comment := range comments {
+			if comment.GetUser().GetLogin() == c.login && strings.Contains(comment.GetBody(), marker) {
+				return comment, nil
+			}
+		}
+		if resp.NextPage == 0 {
+			return nil, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
@@ -0,0 +1,443 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	fixtures "github.com/go-git/go-git-fixtures/v4"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/google/go-github/v29/github"
+	"golang.org/x/perf/benchstat"
+)
+
+// newTestGitHubClient returns a client of the pull request prometheus/prometheus#35
+// for the GitHub API served by mux, and the server to close after the test.
+func newTestGitHubClient(mux *http.ServeMux) (*gitHubClient, *httptest.Server) {
+	srv := httptest.NewServer(mux)
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(srv.URL + "/")
+	return &gitHubClient{
+		owner:    "prometheus",
+		repo:     "prometheus",
+		prNumber: 35,
+		client:   client,
+		ctx:      context.Background(),
+		login:    "funcbench",
+	}, srv
+}
+
+func TestGitHubPostResultsStepSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_step_summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	summary := filepath.Join(dir, "summary.md")
+	os.Setenv("GITHUB_STEP_SUMMARY", summary)
+	defer os.Unsetenv("GITHUB_STEP_SUMMARY")
+
+	c := &benchstat.Collection{}
+	c.AddConfig("file1", []byte("BenchmarkRespond-4	710	1691189 ns/op"))
+	c.AddConfig("file2", []byte("BenchmarkRespond-4	688	1751880 ns/op"))
+
+	g := &GitHub{
+		environment: environment{compareTarget: "master"},
+		client:      &gitHubClient{prNumber: 35, nocomment: true},
+	}
+	g.SetHashStrings("6ecf0ef2", "e8d3ffab")
+	g.SetSubjects("vendor stuff", "Merge branch 'master'")
+	if err := g.PostResults(c.Tables()); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "Respond-4|1.69ms ± 0%|1.75ms ± 0%") {
+		t.Errorf("Expected the results table in the job summary, got:\n%s", b)
+	}
+	expected := "Old: `master`/`6ecf0ef2` (vendor stuff)\nNew: `PR-35`/`e8d3ffab` (Merge branch 'master')"
+	if !strings.Contains(string(b), expected) {
+		t.Errorf("Expected the commit subjects in the legend, got:\n%s", b)
+	}
+}
+
+func TestGitHubPostResultsStepSummaryError(t *testing.T) {
+	// The parent directory doesn't exist, so the job summary can't be written.
+	os.Setenv("GITHUB_STEP_SUMMARY", filepath.Join("testdata", "missing", "summary.md"))
+	defer os.Unsetenv("GITHUB_STEP_SUMMARY")
+
+	var posted string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/prometheus/prometheus/issues/35/comments", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode([]*github.IssueComment{})
+		case http.MethodPost:
+			c := &github.IssueComment{}
+			json.NewDecoder(r.Body).Decode(c)
+			posted = c.GetBody()
+			json.NewEncoder(w).Encode(c)
+		}
+	})
+	client, srv := newTestGitHubClient(mux)
+	defer srv.Close()
+	var logs strings.Builder
+	g := &GitHub{
+		environment: environment{compareTarget: "master", logger: &logger{Logger: log.New(&logs, "", 0)}},
+		client:      client,
+	}
+
+	c := &benchstat.Collection{}
+	c.AddConfig("file1", []byte("BenchmarkRespond-4	710	1691189 ns/op"))
+	c.AddConfig("file2", []byte("BenchmarkRespond-4	688	1751880 ns/op"))
+	if err := g.PostResults(c.Tables()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(posted, "Respond-4|1.69ms ± 0%|1.75ms ± 0%") {
+		t.Errorf("Expected the results to be posted, got:\n%s", posted)
+	}
+	if !strings.Contains(logs.String(), "Failed to write the job summary") {
+		t.Errorf("Expected the job summary error to be logged, got:\n%s", logs.String())
+	}
+}
+
+func TestGitHubClientPostComment(t *testing.T) {
+	var (
+		comments []*github.IssueComment
+		created  int
+		edited   int
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/prometheus/prometheus/issues/35/comments", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(comments)
+		case http.MethodPost:
+			created++
+			c := &github.IssueComment{}
+			json.NewDecoder(r.Body).Decode(c)
+			c.ID = github.Int64(int64(len(comments) + 1))
+			c.User = &github.User{Login: github.String("funcbench")}
+			comments = append(comments, c)
+			json.NewEncoder(w).Encode(c)
+		}
+	})
+	mux.HandleFunc("/repos/prometheus/prometheus/issues/comments/", func(w http.ResponseWriter, r *http.Request) {
+		edited++
+		c := &github.IssueComment{}
+		json.NewDecoder(r.Body).Decode(c)
+		if !strings.HasSuffix(r.URL.Path, "/3") {
+			t.Errorf("Expected to edit the comment with the marker, got %s", r.URL.Path)
+		}
+		json.NewEncoder(w).Encode(c)
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&github.User{Login: github.String("funcbench")})
+	})
+	c, srv := newTestGitHubClient(mux)
+	defer srv.Close()
+	// Looked up from the authenticated user.
+	c.login = ""
+
+	// Comments not posted by funcbench.
+	comments = append(comments,
+		&github.IssueComment{ID: github.Int64(1), Body: github.String("/funcbench master")},
+		&github.IssueComment{ID: github.Int64(2), Body: github.String("> " + commentMarker), User: &github.User{Login: github.String("someone")}},
+	)
+
+	if err := c.postComment(commentMarker, "first"); err != nil {
+		t.Fatal(err)
+	}
+	if created != 1 || edited != 0 {
+		t.Errorf("Expected a new comment to be created, got %d created and %d edited", created, edited)
+	}
+
+	if err := c.postComment(commentMarker, "second"); err != nil {
+		t.Fatal(err)
+	}
+	if created != 1 || edited != 1 {
+		t.Errorf("Expected the previous comment to be edited, got %d created and %d edited", created, edited)
+	}
+
+	// Errors are posted apart from the results.
+	if err := c.postComment(errorCommentMarker, "failed"); err != nil {
+		t.Fatal(err)
+	}
+	if created != 2 || edited != 1 {
+		t.Errorf("Expected a new comment for the error, got %d created and %d edited", created, edited)
+	}
+}
+
+func TestGitHubPostResultsPreviousRun(t *testing.T) {
+	previous, err := ioutil.ReadFile(filepath.Join("testdata", "previous_comment.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		comments []*github.IssueComment
+		posted   string
+		deleted  bool
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/prometheus/prometheus/issues/35/comments", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(comments)
+		case http.MethodPost:
+			c := &github.IssueComment{}
+			json.NewDecoder(r.Body).Decode(c)
+			c.ID = github.Int64(int64(len(comments) + 1))
+			comments = append(comments, c)
+			posted = c.GetBody()
+			json.NewEncoder(w).Encode(c)
+		}
+	})
+	mux.HandleFunc("/repos/prometheus/prometheus/issues/comments/1", func(w http.ResponseWriter, r *http.Request) {
+		c := &github.IssueComment{}
+		json.NewDecoder(r.Body).Decode(c)
+		posted = c.GetBody()
+		json.NewEncoder(w).Encode(c)
+	})
+	mux.HandleFunc("/repos/prometheus/prometheus/issues/comments/2", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			t.Errorf("Expected the error comment to be deleted, got %s", r.Method)
+		}
+		deleted = true
+		w.WriteHeader(http.StatusNoContent)
+	})
+	client, srv := newTestGitHubClient(mux)
+	defer srv.Close()
+	g := &GitHub{
+		environment: environment{compareTarget: "master"},
+		client:      client,
+	}
+
+	c := &benchstat.Collection{DeltaTest: benchstat.NoDeltaTest}
+	c.AddConfig("old", []byte("BenchmarkRespond-4	710	1691189 ns/op\nBenchmarkParse-4	510378	2388 ns/op"))
+	c.AddConfig("new", []byte("BenchmarkRespond-4	688	1500000 ns/op\nBenchmarkParse-4	434798	2374 ns/op"))
+
+	// First run, nothing to compare against.
+	if err := g.PostResults(c.Tables()); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(posted, "vs previous run") {
+		t.Errorf("Expected no previous run column on the first run, got:\n%s", posted)
+	}
+	if !strings.Contains(posted, resultsDataMarker+"\nBenchmarkRespond-4 1 1.5e+06 ns/op\n") {
+		t.Errorf("Expected the results data in the comment, got:\n%s", posted)
+	}
+
+	comments = []*github.IssueComment{
+		{ID: github.Int64(1), Body: github.String(string(previous)), User: &github.User{Login: github.String("funcbench")}},
+		{ID: github.Int64(2), Body: github.String(errorCommentMarker + "\nbenchmark timed out"), User: &github.User{Login: github.String("funcbench")}},
+	}
+	if err := g.PostResults(c.Tables()); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"Benchmark|Old time/op|New time/op|Delta|vs previous run",
+		"Respond-4|1.69ms ± 0%|1.50ms ± 0%|−11.31% |−25.00%",
+		// Not part of the previous run.
+		"Parse-4|2.39µs ± 0%|2.37µs ± 0%|−0.59% |\n",
+	} {
+		if !strings.Contains(posted, expected) {
+			t.Errorf("Expected %q in the comment, got:\n%s", expected, posted)
+		}
+	}
+	if !deleted {
+		t.Error("Expected the error comment of the previous run to be deleted")
+	}
+}
+
+func TestWithResultsData(t *testing.T) {
+	c := &benchstat.Collection{DeltaTest: benchstat.NoDeltaTest}
+	c.AddConfig("old", []byte("BenchmarkRespond-4	710	1691189 ns/op\nBenchmarkRespond-4	710	1691189 ns/op"))
+	c.AddConfig("new", []byte("BenchmarkRespond-4	688	1400000 ns/op\nBenchmarkRespond-4	688	1600000 ns/op"))
+	tables := c.Tables()
+
+	// Only the mean of the runs is kept.
+	comment, ok := withResultsData("results", tables)
+	if expected := "results\n" + resultsDataMarker + "\nBenchmarkRespond-4 1 1.5e+06 ns/op\n-->"; !ok || comment != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, comment)
+	}
+
+	large := strings.Repeat("x", maxCommentLength-len(commentMarker)-10)
+	if comment, ok := withResultsData(large, tables); ok || comment != large {
+		t.Error("Expected the results data to be left out of a comment reaching the maximum length")
+	}
+}
+
+func TestGitHubClientFindCommentWithoutUser(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/prometheus/prometheus/issues/35/comments", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]*github.IssueComment{
+			{ID: github.Int64(1), Body: github.String(commentMarker), User: &github.User{Login: github.String("someone")}},
+			{ID: github.Int64(2), Body: github.String(commentMarker), User: &github.User{Login: github.String(githubActionsLogin)}},
+		})
+	})
+	// Installation tokens can't get the authenticated user.
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	c, srv := newTestGitHubClient(mux)
+	defer srv.Close()
+	c.login = ""
+
+	comment, err := c.findComment(commentMarker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comment.GetID() != 2 {
+		t.Errorf("Expected the comment of %s, got %v", githubActionsLogin, comment)
+	}
+}
+
+func TestGitHubPostResultsToGist(t *testing.T) {
+	var (
+		posted     string
+		gist       *github.Gist
+		gistStatus = http.StatusCreated
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/prometheus/prometheus/issues/35/comments", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode([]*github.IssueComment{})
+		case http.MethodPost:
+			c := &github.IssueComment{}
+			json.NewDecoder(r.Body).Decode(c)
+			posted = c.GetBody()
+			json.NewEncoder(w).Encode(c)
+		}
+	})
+	mux.HandleFunc("/gists", func(w http.ResponseWriter, r *http.Request) {
+		gist = &github.Gist{}
+		json.NewDecoder(r.Body).Decode(gist)
+		w.WriteHeader(gistStatus)
+		json.NewEncoder(w).Encode(&github.Gist{HTMLURL: github.String("https://gist.github.com/funcbench/1")})
+	})
+	client, srv := newTestGitHubClient(mux)
+	defer srv.Close()
+	client.resultsToGist = true
+	g := &GitHub{
+		environment: environment{compareTarget: "master", logger: &logger{Logger: log.New(ioutil.Discard, "", 0)}},
+		client:      client,
+	}
+
+	c := &benchstat.Collection{DeltaTest: benchstat.NoDeltaTest}
+	c.AddConfig("old", []byte("BenchmarkRespond-4	710	1691189 ns/op\nBenchmarkParse-4	510378	2388 ns/op"))
+	c.AddConfig("new", []byte("BenchmarkRespond-4	688	1500000 ns/op\nBenchmarkParse-4	434798	2374 ns/op"))
+
+	if err := g.PostResults(c.Tables()); err != nil {
+		t.Fatal(err)
+	}
+	file := gist.Files["funcbench.md"]
+	if content := file.GetContent(); !strings.Contains(content, "Respond-4|1.69ms ± 0%|1.50ms ± 0%|−11.31% ") {
+		t.Errorf("Expected the results in the gist, got:\n%s", content)
+	}
+	for _, expected := range []string{
+		"Full results: https://gist.github.com/funcbench/1",
+		"time/op: 2 better, 0 worse, 0 unchanged",
+	} {
+		if !strings.Contains(posted, expected) {
+			t.Errorf("Expected %q in the comment, got:\n%s", expected, posted)
+		}
+	}
+	if strings.Contains(posted, "Respond-4|") {
+		t.Errorf("Expected no results table in the comment, got:\n%s", posted)
+	}
+
+	// Falls back to posting the results in the comment.
+	gistStatus = http.StatusInternalServerError
+	if err := g.PostResults(c.Tables()); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(posted, "gist.github.com") || !strings.Contains(posted, "Respond-4|1.69ms ± 0%|1.50ms ± 0%|−11.31% ") {
+		t.Errorf("Expected the results in the comment, got:\n%s", posted)
+	}
+}
+
+func TestGitHubClientBaseRef(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/prometheus/prometheus/pulls/35", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&github.PullRequest{
+			Number: github.Int(35),
+			Base:   &github.PullRequestBranch{Ref: github.String("release-2.20")},
+		})
+	})
+	c, srv := newTestGitHubClient(mux)
+	defer srv.Close()
+
+	base, err := c.baseRef()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base != "release-2.20" {
+		t.Errorf("Expected base branch release-2.20, got %s", base)
+	}
+
+	c.prNumber = 36
+	if _, err := c.baseRef(); err == nil {
+		t.Error("Expected an error for an unknown pull request")
+	}
+}
+
+func TestDefaultBranch(t *testing.T) {
+	f := fixtures.Basic().One()
+	sto := filesystem.NewStorage(f.DotGit(), cache.NewObjectLRUDefault())
+	r, err := git.Open(sto, f.DotGit())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Storer.RemoveReference(plumbing.NewRemoteHEADReferenceName("origin")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := defaultBranch(r); err == nil {
+		t.Error("Expected an error without refs/remotes/origin/HEAD")
+	}
+
+	head := plumbing.NewSymbolicReference(plumbing.NewRemoteHEADReferenceName("origin"), plumbing.NewRemoteReferenceName("origin", "master"))
+	if err := r.Storer.SetReference(head); err != nil {
+		t.Fatal(err)
+	}
+	branch, err := defaultBranch(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if branch != "origin/master" {
+		t.Errorf("Expected default branch origin/master, got %s", branch)
+	}
+	if hash := getTargetInfo(r, branch); hash.String() != "6ecf0ef2c2dffb796033e5a02219af86ec6584e5" {
+		t.Errorf("Expected the default branch to resolve to master, got %s", hash)
+	}
+}
@@ -18,16 +18,20 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/oklog/run"
 	"github.com/pkg/errors"
 	"golang.org/x/perf/benchstat"
@@ -55,6 +59,7 @@ func main() {
 	cfg := struct {
 		verbose        bool
 		nocomment      bool
+		resultsToGist  bool
 		owner          string
 		repo           string
 		resultsDir     string
@@ -62,10 +67,47 @@ func main() {
 		ghPR           int
 		benchTime      time.Duration
 		benchTimeout   time.Duration
+		timeoutAction  string
+		warmup         bool
+		saveRaw        bool
+		requireParity  bool
+		count          int
+		maxNoise       float64
+		minRuntime     time.Duration
+		deltaPrecision int
+		fixedUnit      string
 		compareTarget  string
 		benchFuncRegex string
 		packagePath    string
+		packages       []string
+		oldSubBench    string
+		newSubBench    string
+		subBenchBy     string
+		qualified      bool
+		goos           string
+		goarch         string
+		runner         string
+		benchEnv       []string
+		buildCache     string
+		cleanCache     bool
+		showEnv        bool
+		reportWarnings bool
+		streamJSONL    string
+		cpuProfile     bool
+		notifyURL      string
+		race           bool
+		benchList      string
+		list           bool
+		keepWorktree   bool
+		worktreeDir    string
+		dirty          bool
+		targetRemote   string
+		output         string
+		outputFormat   string
+		baselineFile   string
 	}{}
+	showEnvSet := false
+	reportWarningsSet := false
 
 	app := kingpin.New(
 		filepath.Base(os.Args[0]),
@@ -74,7 +116,11 @@ func main() {
 		* For BenchmarkFunc.*, compare current with master: ./funcbench -v master BenchmarkFunc.*
 		* For all benchmarks, compare current with devel: ./funcbench -v devel .* or ./funcbench -v devel
 		* For BenchmarkFunc.*, compare current with 6d280 commit: ./funcbench -v 6d280 BenchmarkFunc.*
-		* For BenchmarkFunc.*, compare between sub-benchmarks of same benchmark on current commit: ./funcbench -v . BenchmarkFunc.*
+		* For BenchmarkFunc.*, compare between sub-benchmarks of same benchmark on current commit: ./funcbench -v --old-sub="size=small" --new-sub="size=large" . BenchmarkFunc.*
+		* For BenchmarkFunc.*, compare across the samples sub-benchmark dimension on current commit: ./funcbench -v --subbench-by=samples . BenchmarkFunc.*
+		* For all benchmarks, compare current with the default branch: ./funcbench -v
+		* For BenchmarkFunc.* and BenchmarkOther, compare current with master: ./funcbench -v --bench-list=BenchmarkOther master BenchmarkFunc.*
+		* For BenchmarkFunc.*, list the benchmarks which would run without running them: ./funcbench --list . BenchmarkFunc.*
 		* For BenchmarkFuncName, compare pr#35 with master: ./funcbench --nocomment --github-pr="35" master BenchmarkFuncName`,
 	)
 	// Options.
@@ -83,6 +129,12 @@ func main() {
 		Short('v').BoolVar(&cfg.verbose)
 	app.Flag("nocomment", "Disable posting of comment using the GitHub API.").
 		BoolVar(&cfg.nocomment)
+	app.Flag("notify", "Webhook URL to post a short summary of the results or the error to when the comparison is done, eg. a Slack incoming webhook. "+
+		"Failing to notify doesn't fail the run.").
+		StringVar(&cfg.notifyURL)
+	app.Flag("results-to-gist", "Upload the results to a secret GitHub gist and only post a summary linking to it in the comment, "+
+		"eg. for large comparisons. The results are posted in the comment if the gist can't be created.").
+		BoolVar(&cfg.resultsToGist)
 
 	app.Flag("owner", "A Github owner or organisation name.").
 		Default("prometheus").StringVar(&cfg.owner)
@@ -90,6 +142,10 @@ func main() {
 		Default("prometheus").StringVar(&cfg.repo)
 	app.Flag("github-pr", "GitHub PR number to pull changes from and to post benchmark results.").
 		IntVar(&cfg.ghPR)
+	app.Flag("target-remote", "URL of a repository to fetch and resolve the target from, eg. the upstream repository of a fork. "+
+		"The base target stands for its default branch. GITHUB_TOKEN is used for authentication to github.com if set. "+
+		"The remote is removed once done.").
+		StringVar(&cfg.targetRemote)
 	app.Flag("workspace", "Directory to clone GitHub PR.").
 		Default("/tmp/funcbench").
 		StringVar(&cfg.workspaceDir)
@@ -97,18 +153,124 @@ func main() {
 		Default("_dev/funcbench").
 		StringVar(&cfg.resultsDir)
 
+	app.Flag("package", "Package to run benchmark against, can be repeated. Eg. --package=./tsdb --package=./promql. "+
+		"Takes precedence over the packagepath argument.").
+		StringsVar(&cfg.packages)
+	app.Flag("output", "File to additionally write the benchmark results to.").
+		StringVar(&cfg.output)
+	app.Flag("stream-jsonl", "File to write a JSON object per compared benchmark metric to, one per line, as soon as the comparison is done, eg. a named pipe. "+
+		"The objects are in the same order as the rows of the results, which are still posted and written to --output.").
+		StringVar(&cfg.streamJSONL)
+	app.Flag("output-format", "Format of the results written to --output.").
+		Default("text").EnumVar(&cfg.outputFormat, "text", "markdown", "html")
+
 	app.Flag("bench-time", "Run enough iterations of each benchmark to take t, specified "+
 		"as a time.Duration. The special syntax Nx means to run the benchmark N times").
 		Short('t').Default("1s").DurationVar(&cfg.benchTime)
 	app.Flag("timeout", "Benchmark timeout specified in time.Duration format, "+
-		"disabled if set to 0. If a test binary runs longer than duration d, panic.").
+		"disabled if set to 0. If a test binary runs longer than duration d, the timeout action is taken.").
 		Short('d').Default("2h").DurationVar(&cfg.benchTimeout)
+	app.Flag("timeout-action", "Action when the benchmark runs longer than the timeout. "+
+		"'fail' stops with an error, 'skip' continues with the results of the benchmarks finished before the timeout, "+
+		"which may result in one-sided comparisons, 'panic' stops with the panic output of the test binary.").
+		Default(timeoutFail).EnumVar(&cfg.timeoutAction, timeoutFail, timeoutSkip, timeoutPanic)
+	app.Flag("warmup", "Run the benchmarks once with the output discarded before the measured run, "+
+		"for both compared sides, so that the results aren't skewed by cold caches. Roughly doubles the run time.").
+		BoolVar(&cfg.warmup)
+	app.Flag("save-raw", "Write the raw benchmark output of the compared sides to old.txt and new.txt "+
+		"in the result-cache directory, eg. to run benchstat on them or archive them.").
+		BoolVar(&cfg.saveRaw)
+	app.Flag("goos", "GOOS to build the benchmarks for, defaults to the host one.").
+		StringVar(&cfg.goos)
+	app.Flag("goarch", "GOARCH to build the benchmarks for, defaults to the host one.").
+		StringVar(&cfg.goarch)
+	app.Flag("runner", "Program to run the benchmark binaries with, passed to 'go test -exec', eg. a qemu wrapper. "+
+		"Required when --goos or --goarch differ from the host.").
+		StringVar(&cfg.runner)
+	app.Flag("require-parity", "Fail when benchmarks are only present on one of the compared sides, "+
+		"eg. because a benchmark was accidentally removed.").
+		BoolVar(&cfg.requireParity)
+	app.Flag("bench-env", "Environment variable in the KEY=VALUE format to set for the benchmarks "+
+		"of both compared sides, can be repeated. Eg. --bench-env=GOGC=50.").
+		StringsVar(&cfg.benchEnv)
+	app.Flag("build-cache", "Directory to keep the Go build and module cache shared by the benchmarks of both compared sides in, "+
+		"eg. to persist it between CI runs. Defaults to the Go cache of the user.").
+		StringVar(&cfg.buildCache)
+	app.Flag("clean-build-cache", "Remove the --build-cache directory after benchmarking.").
+		BoolVar(&cfg.cleanCache)
+	app.Flag("show-env", "Show the OS, architecture, number of CPUs and Go version of the machine running the benchmarks "+
+		"along with the results. Enabled by default in GitHub mode.").
+		Action(func(*kingpin.ParseContext) error {
+			showEnvSet = true
+			return nil
+		}).BoolVar(&cfg.showEnv)
+	app.Flag("report-warnings", "Show the warnings printed while building the benchmarks of the current side, eg. by cgo, "+
+		"above the results. Enabled by default in GitHub mode.").
+		Action(func(*kingpin.ParseContext) error {
+			reportWarningsSet = true
+			return nil
+		}).BoolVar(&cfg.reportWarnings)
+	app.Flag("cpuprofile", "Collect a CPU profile of the benchmarks of both compared sides next to the results and show the top functions "+
+		"of their difference along with the results. Requires a single package to benchmark.").
+		BoolVar(&cfg.cpuProfile)
+	app.Flag("race", "Run the benchmarks of both compared sides with the race detector and fail if a data race is detected. "+
+		"The race detector slows down the benchmarks, so the results aren't comparable to the ones of runs without it.").
+		BoolVar(&cfg.race)
+	app.Flag("bench-list", "Comma separated list of exact benchmark names to run in addition to the ones matching bench-func-regex. "+
+		"Only the listed benchmarks run when bench-func-regex is left to the default '.*'. Eg. --bench-list=BenchmarkAppend,BenchmarkQuery.").
+		StringVar(&cfg.benchList)
+	app.Flag("list", "List the benchmarks of the current worktree matching bench-func-regex in the packages of packagepath and exit, "+
+		"without running or comparing them.").
+		BoolVar(&cfg.list)
+	app.Flag("dirty", "Benchmark the uncommitted changes of the current worktree instead of requiring a clean worktree. "+
+		"Results of uncommitted changes aren't reproducible and are never reused from the result cache.").
+		BoolVar(&cfg.dirty)
+	app.Flag("worktree-dir", "Directory, relative to the repository root, to checkout the compared target in.").
+		Default("_funcbench-cmp").StringVar(&cfg.worktreeDir)
+	app.Flag("keep-worktree", "Keep the worktree of the compared target after benchmarking for debugging. "+
+		"It is always removed before the next run.").
+		BoolVar(&cfg.keepWorktree)
+	app.Flag("baseline-file", "File with the results of a previous benchmark run to compare against, "+
+		"eg. from a nightly run. The target isn't checked out and benchmarked, it's only used to label the results.").
+		StringVar(&cfg.baselineFile)
+	app.Flag("count", "Run each benchmark n times. Running more than once allows assessing the variance of the results.").
+		Default("1").IntVar(&cfg.count)
+	app.Flag("max-noise", "Coefficient of variation in percent above which a benchmark result is marked as unreliable. "+
+		"Requires --count greater than 1, disabled if set to 0.").
+		Default("5").Float64Var(&cfg.maxNoise)
+	app.Flag("min-runtime", "Time per op below which a benchmark result is marked as unreliable, as it's dominated by the benchmark loop overhead. "+
+		"Disabled if set to 0.").
+		Default("1ns").DurationVar(&cfg.minRuntime)
+	app.Flag("delta-precision", "Number of decimal places of the deltas in the results.").
+		Default("2").IntVar(&cfg.deltaPrecision)
+	app.Flag("fixed-unit", "Time unit to show all time results in, one of ns, us, µs, ms or s. By default the unit is picked for every benchmark based on its magnitude.").
+		EnumVar(&cfg.fixedUnit, "ns", "us", "µs", "ms", "s")
+	app.Flag("old-sub", "Sub-benchmark name pattern to use as the old side when target is '.'. "+
+		"Supports RE2 regexp and is fully anchored against a single sub-benchmark name element. "+
+		"Only benchmarks matched by bench-func-regex are considered.").
+		StringVar(&cfg.oldSubBench)
+	app.Flag("new-sub", "Sub-benchmark name pattern to use as the new side when target is '.'. "+
+		"Supports RE2 regexp and is fully anchored against a single sub-benchmark name element. "+
+		"Only benchmarks matched by bench-func-regex are considered.").
+		StringVar(&cfg.newSubBench)
+	app.Flag("subbench-by", "Sub-benchmark dimension to compare across when target is '.', eg. 'samples' for "+
+		"BenchmarkFunc/series=1000/samples=100. A table is reported for every combination of the other dimensions, "+
+		"with a column for each value of the dimension when there are more than two. "+
+		"Errors out if a matched benchmark doesn't have the dimension. Can't be used with --old-sub and --new-sub.").
+		StringVar(&cfg.subBenchBy)
+
+	app.Flag("qualified", "Match bench-func-regex against the package-qualified benchmark name, "+
+		`eg. 'storage/.*\.BenchmarkAppend', to disambiguate benchmarks with the same name in different packages. `+
+		"The package part matches whole trailing elements of the import path of the benchmarked packages.").
+		BoolVar(&cfg.qualified)
 
 	app.Arg("target", "Can be one of '.', tag name, branch name or commit SHA of the branch "+
 		"to compare against. If set to '.', branch/commit is the same as the current one; "+
-		"funcbench will run once and try to compare between 2 sub-benchmarks. "+
-		"Errors out if there are no sub-benchmarks.").
-		Required().StringVar(&cfg.compareTarget)
+		"funcbench will run once and compare the sub-benchmarks selected by --old-sub and --new-sub. "+
+		"Errors out if either of them matches no sub-benchmarks. "+
+		"If set to 'base' or omitted, the base branch of the PR in GitHub mode "+
+		"or the default branch of the origin remote in local mode is used.").
+		Default(baseTarget).StringVar(&cfg.compareTarget)
 	app.Arg("bench-func-regex", "Function regex to use for benchmark."+
 		"Supports RE2 regexp and is fully anchored, by default will run all benchmarks.").
 		Default(".*").
@@ -117,7 +279,25 @@ func main() {
 		Default("./...").
 		StringVar(&cfg.packagePath)
 
+	app.Flag("config", "Config file with default values for the flags, keyed by the long flag name. "+
+		"Flags passed on the command line take precedence over it.").
+		Default(defaultConfigFile).String()
+
+	cfgFile, explicit := configFile(os.Args[1:])
+	configured, err := applyConfigFile(app, cfgFile, explicit)
+	if err != nil {
+		app.Fatalf("%v", err)
+	}
 	kingpin.MustParse(app.Parse(os.Args[1:]))
+	// Values of the config file are set explicitly as well, eg. to disable a default of GitHub mode.
+	showEnvSet = showEnvSet || configured["show-env"]
+	reportWarningsSet = reportWarningsSet || configured["report-warnings"]
+	if cfg.deltaPrecision < 0 {
+		app.Fatalf("--delta-precision can't be negative, got %d", cfg.deltaPrecision)
+	}
+	if cfg.baselineFile != "" && cfg.compareTarget == "." {
+		app.Fatalf("--baseline-file can't be used with the '.' target comparing sub-benchmarks")
+	}
 	logger := &logger{
 		// Show file line with each log.
 		Logger:  log.New(os.Stdout, "funcbech", log.Ltime|log.Lshortfile),
@@ -134,11 +314,31 @@ func main() {
 				err error
 			)
 
+			var benchList []string
+			if cfg.benchList != "" {
+				benchList = strings.Split(cfg.benchList, ",")
+			}
+			benchFunc, err := benchSelection(cfg.benchFuncRegex, benchList)
+			if err != nil {
+				return errors.Wrap(err, "benchmark selection")
+			}
+
+			compareTarget := cfg.compareTarget
+			if cfg.list {
+				// Listing the benchmarks doesn't need the target, which might not be resolvable.
+				compareTarget = "."
+			}
+			if cfg.baselineFile != "" && compareTarget == baseTarget {
+				// The baseline file replaces the target, the default branch doesn't need to be resolved.
+				compareTarget = "baseline"
+			}
+
 			// Setup Environment.
 			e := environment{
 				logger:        logger,
-				benchFunc:     cfg.benchFuncRegex,
-				compareTarget: cfg.compareTarget,
+				benchFunc:     benchFunc,
+				compareTarget: compareTarget,
+				targetRemote:  cfg.targetRemote,
 			}
 			if cfg.ghPR == 0 {
 				// Local Mode.
@@ -148,48 +348,153 @@ func main() {
 				}
 			} else {
 				// Github Mode.
-				ghClient, err := newGitHubClient(ctx, cfg.owner, cfg.repo, cfg.ghPR, cfg.nocomment)
+				ghClient, err := newGitHubClient(ctx, cfg.owner, cfg.repo, cfg.ghPR, cfg.nocomment, cfg.resultsToGist)
 				if err != nil {
 					return errors.Wrapf(err, "github client")
 				}
 
 				env, err = newGitHubEnv(ctx, e, ghClient, cfg.workspaceDir)
 				if err != nil {
-					if err := ghClient.postComment(fmt.Sprintf("%v. Could not setup environment, please check logs.", err)); err != nil {
+					if err := ghClient.postComment(errorCommentMarker, fmt.Sprintf("%v. Could not setup environment, please check logs.", err)); err != nil {
 						return errors.Wrap(err, "could not post error")
 					}
 					return errors.Wrap(err, "environment create")
 				}
 			}
 
+			if env.TargetRemote() != "" {
+				defaultBranch, err := fetchTargetRemote(ctx, env.Repo(), env.TargetRemote())
+				if err != nil {
+					return errors.Wrapf(err, "fetch target remote %s", env.TargetRemote())
+				}
+				defer func() {
+					if err := removeTargetRemote(env.Repo()); err != nil {
+						logger.Println("Failed to remove the target remote:", err)
+					}
+				}()
+				if env.CompareTarget() == baseTarget {
+					env.SetCompareTarget(defaultBranch)
+				}
+			}
+
+			packages := cfg.packages
+			if len(packages) == 0 {
+				packages = []string{cfg.packagePath}
+			}
+
+			var cacheEnv []string
+			if cfg.buildCache != "" {
+				if cacheEnv, err = buildCacheEnv(cfg.buildCache); err != nil {
+					return errors.Wrap(err, "build cache")
+				}
+				if cfg.cleanCache {
+					defer func() {
+						if err := removeBuildCache(cfg.buildCache); err != nil {
+							logger.Println("Failed to remove the build cache:", err)
+						}
+					}()
+				}
+			}
+
 			// ( ◔_◔)ﾉ Start benchmarking!
-			benchmarker := newBenchmarker(logger, env,
-				&commander{verbose: cfg.verbose, ctx: ctx},
-				cfg.benchTime, cfg.benchTimeout, cfg.resultsDir,
-				cfg.packagePath,
-			)
-			tables, err := startBenchmark(env, benchmarker)
+			benchmarker, err := newBenchmarker(logger, env, &commander{verbose: cfg.verbose, ctx: ctx}, benchmarkOptions{
+				benchTime:       cfg.benchTime,
+				benchTimeout:    cfg.benchTimeout,
+				timeoutAction:   cfg.timeoutAction,
+				count:           cfg.count,
+				packagePaths:    packages,
+				resultCacheDir:  cfg.resultsDir,
+				warmup:          cfg.warmup,
+				saveRaw:         cfg.saveRaw,
+				requireParity:   cfg.requireParity,
+				reportWarnings:  cfg.reportWarnings || (!reportWarningsSet && cfg.ghPR != 0),
+				cpuProfile:      cfg.cpuProfile,
+				race:            cfg.race,
+				qualified:       cfg.qualified,
+				oldSubBenchmark: cfg.oldSubBench,
+				newSubBenchmark: cfg.newSubBench,
+				subBenchmarkBy:  cfg.subBenchBy,
+				goos:            cfg.goos,
+				goarch:          cfg.goarch,
+				runner:          cfg.runner,
+				benchEnv:        cfg.benchEnv,
+				cacheEnv:        cacheEnv,
+			})
+			if err != nil {
+				return errors.Wrap(err, "benchmarker create")
+			}
+			if cfg.list {
+				wt, err := env.Repo().Worktree()
+				if err != nil {
+					return err
+				}
+				names, err := benchmarker.list(wt.Filesystem.Root())
+				if err != nil {
+					return errors.Wrap(err, "list benchmarks")
+				}
+				for _, n := range names {
+					fmt.Println(n)
+				}
+				logger.Println(len(names), "benchmark(s) match", cfg.benchFuncRegex)
+				return nil
+			}
+			if cfg.race {
+				logger.Println("Running with the race detector, the results aren't comparable to runs without it.")
+			}
+			tables, info, err := startBenchmark(env, benchmarker, cfg.worktreeDir, cfg.baselineFile, cfg.keepWorktree, cfg.dirty)
 			if err != nil {
-				pErr := env.PostErr(
-					fmt.Sprintf(
-						"```\n%s\n```\nError:\n```\n%s\n```",
-						strings.Join(benchmarker.benchmarkArgs, " "),
-						err.Error(),
-					),
-				)
+				msg := fmt.Sprintf("```\n%s\n```\nError:\n```\n%s\n```", strings.Join(benchmarker.benchmarkArgs, " "), err.Error())
+				if bErr, ok := errors.Cause(err).(*buildError); ok {
+					msg = fmt.Sprintf("```\n%s\n```\nBenchmark failed to compile:\n```\n%s\n```", strings.Join(benchmarker.benchmarkArgs, " "), bErr.diagnostics)
+				}
+				if _, ok := errors.Cause(err).(*raceError); ok {
+					msg = fmt.Sprintf("```\n%s\n```\nData race detected:\n```\n%s\n```", strings.Join(benchmarker.benchmarkArgs, " "), err.Error())
+				}
+				pErr := env.PostErr(msg)
+				if cfg.notifyURL != "" {
+					if err := notify(cfg.notifyURL, failureSummary(env, err)); err != nil {
+						logger.Println("Failed to notify about the error:", err)
+					}
+				}
 
 				if pErr != nil {
-					return errors.Wrap(pErr, "could not log error")
+					logger.Println("Failed to post the error:", pErr)
 				}
 				return err
 			}
 
+			if cfg.streamJSONL != "" {
+				if err := streamJSONL(cfg.streamJSONL, tables); err != nil {
+					return errors.Wrap(err, "stream results")
+				}
+			}
+			info = append(info, markNoisyRows(tables, cfg.maxNoise), markShortRows(tables, cfg.minRuntime))
+			if err := formatRows(tables, cfg.deltaPrecision, cfg.fixedUnit); err != nil {
+				return errors.Wrap(err, "format results")
+			}
+			if cfg.showEnv || (!showEnvSet && cfg.ghPR != 0) {
+				info = append(info, runnerInfo(goVersion(benchmarker.c)))
+			}
+			if cfg.output != "" {
+				if err := writeResults(cfg.output, cfg.outputFormat, tables, info...); err != nil {
+					return errors.Wrapf(err, "write results to %s", cfg.output)
+				}
+			}
+
 			// Post results.
 			// TODO (geekodour): probably post some kind of funcbench summary(?)
-			return env.PostResults(
+			if err := env.PostResults(
 				tables,
-				fmt.Sprintf("```\n%s\n```", strings.Join(benchmarker.benchmarkArgs, " ")),
-			)
+				append([]string{fmt.Sprintf("```\n%s\n```", strings.Join(benchmarker.benchmarkArgs, " "))}, info...)...,
+			); err != nil {
+				return err
+			}
+			if cfg.notifyURL != "" {
+				if err := notify(cfg.notifyURL, completionSummary(env, tables)); err != nil {
+					logger.Println("Failed to notify about the results:", err)
+				}
+			}
+			return nil
 
 		}, func(err error) {
 			cancel()
@@ -211,93 +516,223 @@ func main() {
 	logger.Println("exiting")
 }
 
-// startBenchmark returns the comparision results.
-// 1. If target is same as current ref, run sub-benchmarks and return instead (TODO).
-// 2. Execute benchmark against packages in the current worktree.
+// startBenchmark returns the comparision results along with additional information about them.
+// 1. If target is same as current ref, run sub-benchmarks and return instead.
+// 2. Execute benchmark against packages in the current worktree, including uncommitted changes if dirty is set.
 // 3. Cleanup of worktree in case funcbench was run previously and checkout target worktree.
 // 4. Execute benchmark against packages in the new(target) worktree.
-// 5. Return compared results.
-func startBenchmark(env Environment, bench *Benchmarker) ([]*benchstat.Table, error) {
+// 5. Cleanup of target worktree unless keepWorktree is set.
+// 6. Return compared results.
+func startBenchmark(env Environment, bench *Benchmarker, worktreeDir, baselineFile string, keepWorktree, dirty bool) ([]*benchstat.Table, []string, error) {
+	if filepath.IsAbs(worktreeDir) {
+		return nil, nil, errors.Errorf("worktree directory %s has to be relative to the repository root", worktreeDir)
+	}
 
 	wt, _ := env.Repo().Worktree()
-	cmpWorkTreeDir := filepath.Join(wt.Filesystem.Root(), "_funcbench-cmp")
+	cmpWorkTreeDir := filepath.Join(wt.Filesystem.Root(), worktreeDir)
 
 	ref, err := env.Repo().Head()
 	if err != nil {
-		return nil, errors.Wrap(err, "get head")
+		return nil, nil, errors.Wrap(err, "get head")
 	}
 
-	// TODO move it into env? since GitHub env doesn't need this check.
-	if _, err := bench.c.exec("sh", "-c", "git update-index -q --ignore-submodules --refresh && git diff-files --quiet --ignore-submodules --"); err != nil {
-		return nil, errors.Wrap(err, "not clean worktree")
+	// The hash identifying the current worktree, zero when benchmarking uncommitted changes.
+	current := ref.Hash()
+	if dirty {
+		bench.logger.Println("Benchmarking uncommitted changes of the current worktree, results aren't reproducible.")
+		current = plumbing.ZeroHash
+	} else {
+		// TODO move it into env? since GitHub env doesn't need this check.
+		if _, err := bench.c.exec("sh", "-c", "git update-index -q --ignore-submodules --refresh && git diff-files --quiet --ignore-submodules --"); err != nil {
+			return nil, nil, errors.Wrap(err, "not clean worktree")
+		}
 	}
 
 	if env.CompareTarget() == "." {
 		bench.logger.Println("Assuming sub-benchmarks comparison.")
-		subResult, err := bench.exec(wt.Filesystem.Root(), ref.Hash())
+		subResult, err := bench.exec(wt.Filesystem.Root(), current)
 		if err != nil {
-			return nil, errors.Wrap(err, "execute sub-benchmark")
+			return nil, nil, errors.Wrap(err, "execute sub-benchmark")
 		}
 
 		cmps, err := bench.compareSubBenchmarks(subResult)
 		if err != nil {
-			return nil, errors.Wrap(err, "comparing sub benchmarks")
+			return nil, nil, errors.Wrap(err, "comparing sub benchmarks")
+		}
+		warnings, err := bench.buildWarningsNote(subResult)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "build warnings")
+		}
+		// The compared sub-benchmarks are shown as the columns of more than two of them.
+		if configs := cmps[0].Configs; len(configs) == 2 {
+			return cmps, []string{warnings, fmt.Sprintf("Old: `%s`\nNew: `%s`", configs[0], configs[1])}, nil
 		}
-		return cmps, nil
+		return cmps, []string{warnings}, nil
+	}
+
+	if baselineFile != "" {
+		return compareWithBaseline(env, bench, wt.Filesystem.Root(), baselineFile, ref, current, dirty)
 	}
 
 	// Get info about target.
-	targetCommit := getTargetInfo(env.Repo(), env.CompareTarget())
+	targetCommit := plumbing.ZeroHash
+	if env.TargetRemote() != "" {
+		targetCommit = getTargetInfo(env.Repo(), targetRemoteName+"/"+env.CompareTarget())
+		if targetCommit == plumbing.ZeroHash {
+			targetCommit = getTargetInfo(env.Repo(), targetRemoteName+"/tags/"+env.CompareTarget())
+		}
+	}
 	if targetCommit == plumbing.ZeroHash {
-		return nil, fmt.Errorf("cannot find target %s", env.CompareTarget())
+		targetCommit = getTargetInfo(env.Repo(), env.CompareTarget())
+	}
+	if targetCommit == plumbing.ZeroHash {
+		return nil, nil, fmt.Errorf("cannot find target %s", env.CompareTarget())
 	}
 
 	bench.logger.Println("Target:", targetCommit.String(), "Current Ref:", ref.Hash().String())
 
-	if targetCommit == ref.Hash() {
-		return nil, fmt.Errorf("target: %s is the same as current ref %s (or is on the same commit); No changes would be expected; Aborting", targetCommit, ref.String())
+	if targetCommit == ref.Hash() && !dirty {
+		return nil, nil, fmt.Errorf("target: %s is the same as current ref %s (or is on the same commit); No changes would be expected; Aborting", targetCommit, ref.String())
 	}
 
-	bench.logger.Println("Assuming comparing with target (clean workdir will be checked.)")
+	bench.logger.Println("Assuming comparing with target.")
 
 	// Execute benchmark A.
-	newResult, err := bench.exec(wt.Filesystem.Root(), ref.Hash())
+	newResult, err := bench.exec(wt.Filesystem.Root(), current)
 	if err != nil {
-		return nil, errors.Wrapf(err, "execute benchmark for A: %v", ref.Name().String())
+		return nil, nil, errors.Wrapf(err, "execute benchmark for A: %v", ref.Name().String())
 	}
 
-	// TODO move the following part before 'Execute benchmark B.' into a function Benchmarker.switchToWorkTree.
-	// Best effort cleanup and checkout new worktree.
-	if err := os.RemoveAll(cmpWorkTreeDir); err != nil {
-		return nil, errors.Wrapf(err, "delete worktree at %s", cmpWorkTreeDir)
+	if err := bench.switchToWorkTree(cmpWorkTreeDir, targetCommit); err != nil {
+		return nil, nil, err
 	}
 
-	// TODO (geekodour): switch to worktree remove once we decide not to support git<2.17
-	if _, err := bench.c.exec("git", "worktree", "prune"); err != nil {
-		return nil, errors.Wrap(err, "worktree prune")
+	// Execute benchmark B.
+	oldResult, err := bench.execTarget(cmpWorkTreeDir, targetCommit)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "execute benchmark for B: %v", env.CompareTarget())
 	}
 
-	bench.logger.Println("Checking out (in new workdir):", cmpWorkTreeDir, "commmit", targetCommit.String())
-	if _, err := bench.c.exec("git", "worktree", "add", "-f", cmpWorkTreeDir, targetCommit.String()); err != nil {
-		return nil, errors.Wrapf(err, "checkout %s in worktree %s", targetCommit.String(), cmpWorkTreeDir)
+	if keepWorktree {
+		bench.logger.Println("Keeping worktree of target", targetCommit.String(), "at:", cmpWorkTreeDir, "(it will be removed on the next run)")
+	} else if err := bench.removeWorkTree(cmpWorkTreeDir); err != nil {
+		return nil, nil, err
 	}
 
-	// Execute benchmark B.
-	oldResult, err := bench.exec(cmpWorkTreeDir, targetCommit)
-	if err != nil {
-		return nil, errors.Wrapf(err, "execute benchmark for B: %v", env.CompareTarget())
+	if err := bench.saveRawResults(oldResult, newResult); err != nil {
+		return nil, nil, errors.Wrap(err, "save raw results")
 	}
 
 	// Compare B vs A.
-	tables, err := compareBenchmarks(oldResult, newResult)
+	tables, info, err := compareResults(oldResult, newResult, bench.requireParity)
 	if err != nil {
-		return nil, errors.Wrap(err, "comparing benchmarks")
+		return nil, nil, err
 	}
+	warnings, err := bench.buildWarningsNote(newResult)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "build warnings")
+	}
+	info = append([]string{warnings}, info...)
+	profileDiff, err := bench.cpuProfileDiff(oldResult, newResult)
+	if err != nil {
+		return nil, nil, err
+	}
+	info = append(info, profileDiff)
 
 	// Save hashes for info about benchmark.
-	env.SetHashStrings(targetCommit.String(), ref.Hash().String())
+	env.SetHashStrings(targetCommit.String(), headHashString(ref, dirty))
+	env.SetSubjects(commitSubject(env.Repo(), targetCommit), commitSubject(env.Repo(), ref.Hash()))
 
-	return tables, nil
+	return tables, info, nil
+}
+
+// compareWithBaseline runs only benchmark A and compares it against the
+// results of a previous run stored in baselineFile.
+func compareWithBaseline(env Environment, bench *Benchmarker, root, baselineFile string, ref *plumbing.Reference, current plumbing.Hash, dirty bool) ([]*benchstat.Table, []string, error) {
+	if err := validateBenchmarkFile(baselineFile); err != nil {
+		return nil, nil, errors.Wrapf(err, "baseline file %s", baselineFile)
+	}
+
+	bench.logger.Println("Assuming comparing with baseline file:", baselineFile)
+
+	// Execute benchmark A.
+	newResult, err := bench.exec(root, current)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "execute benchmark for A: %v", ref.Name().String())
+	}
+
+	if err := bench.saveRawResults(baselineFile, newResult); err != nil {
+		return nil, nil, errors.Wrap(err, "save raw results")
+	}
+
+	tables, info, err := compareResults(baselineFile, newResult, bench.requireParity)
+	if err != nil {
+		return nil, nil, err
+	}
+	warnings, err := bench.buildWarningsNote(newResult)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "build warnings")
+	}
+	info = append([]string{warnings}, info...)
+
+	env.SetHashStrings(baselineFile, headHashString(ref, dirty))
+	env.SetSubjects("", commitSubject(env.Repo(), ref.Hash()))
+
+	return tables, info, nil
+}
+
+// compareResults compares the old and new results and returns the benchstat
+// tables along with the info about the benchmarks present on one side only.
+// With requireParity, benchmarks present on one side only are an error instead.
+func compareResults(oldResult, newResult string, requireParity bool) ([]*benchstat.Table, []string, error) {
+	tables, err := compareBenchmarks(oldResult, newResult)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "comparing benchmarks")
+	}
+
+	added, removed, err := diffBenchmarkSets(oldResult, newResult)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "diff benchmark sets")
+	}
+	if requireParity && (len(added) > 0 || len(removed) > 0) {
+		return nil, nil, errors.Errorf("benchmarks are only present on one side:\n%s", strings.Join(formatBenchmarkSetDiff(added, removed), "\n"))
+	}
+	return tables, formatBenchmarkSetDiff(added, removed), nil
+}
+
+func headHashString(ref *plumbing.Reference, dirty bool) string {
+	if dirty {
+		return ref.Hash().String() + " (with uncommitted changes)"
+	}
+	return ref.Hash().String()
+}
+
+// runnerInfo returns a line describing the machine running the benchmarks,
+// as results are only comparable on identical hardware.
+func runnerInfo(goVersion string) string {
+	return fmt.Sprintf("Environment: %s/%s, %d CPUs, %s", runtime.GOOS, runtime.GOARCH, runtime.NumCPU(), goVersion)
+}
+
+// goVersion returns the version of the go command running the benchmarks.
+func goVersion(c *commander) string {
+	out, err := c.exec("go", "env", "GOVERSION")
+	if v := strings.TrimSpace(out); err == nil && v != "" {
+		return v
+	}
+	return runtime.Version()
+}
+
+func writeResults(fileName, format string, tables []*benchstat.Table, info ...string) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := render(f, format, tables, info...); err != nil {
+		return err
+	}
+	return f.Close()
 }
 
 func interrupt(logger Logger, cancel <-chan struct{}) error {
@@ -323,25 +758,116 @@ func getTargetInfo(repo *git.Repository, target string) plumbing.Hash {
 	return *hash
 }
 
+// commitSubject returns the first line of the commit message,
+// or an empty string if the commit can't be found.
+func commitSubject(repo *git.Repository, hash plumbing.Hash) string {
+	c, err := repo.CommitObject(hash)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.SplitN(c.Message, "\n", 2)[0])
+}
+
+const targetRemoteName = "funcbench-target"
+
+// fetchTargetRemote (re)creates the remote to resolve the target from and fetches its branches and tags,
+// the tags into refs/remotes/<targetRemoteName>/tags so that they don't replace the tags of the repository.
+// It returns the default branch of the remote.
+func fetchTargetRemote(ctx context.Context, repo *git.Repository, remoteURL string) (string, error) {
+	if err := removeTargetRemote(repo); err != nil {
+		return "", err
+	}
+	remote, err := repo.CreateRemote(&config.RemoteConfig{
+		Name: targetRemoteName,
+		URLs: []string{remoteURL},
+		Fetch: []config.RefSpec{
+			config.RefSpec(fmt.Sprintf("+refs/heads/*:refs/remotes/%s/*", targetRemoteName)),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	opts := &git.FetchOptions{
+		RefSpecs: []config.RefSpec{
+			config.RefSpec(fmt.Sprintf("+refs/heads/*:refs/remotes/%s/*", targetRemoteName)),
+			config.RefSpec(fmt.Sprintf("+refs/tags/*:refs/remotes/%s/tags/*", targetRemoteName)),
+		},
+		Tags:     git.NoTags,
+		Progress: os.Stdout,
+	}
+	// The token is only meant for GitHub.
+	if token, ok := os.LookupEnv("GITHUB_TOKEN"); ok && isGitHubURL(remoteURL) {
+		opts.Auth = &http.BasicAuth{Username: "funcbench", Password: token}
+	}
+	if err := remote.FetchContext(ctx, opts); err != nil && err != git.NoErrAlreadyUpToDate {
+		return "", err
+	}
+
+	refs, err := remote.List(&git.ListOptions{Auth: opts.Auth})
+	if err != nil {
+		return "", errors.Wrap(err, "list references")
+	}
+	for _, ref := range refs {
+		if ref.Name() == plumbing.HEAD && ref.Type() == plumbing.SymbolicReference {
+			return ref.Target().Short(), nil
+		}
+	}
+	return "", errors.Errorf("can't determine the default branch of %s", remoteURL)
+}
+
+// removeTargetRemote removes the remote created by fetchTargetRemote along with its fetched references.
+func removeTargetRemote(repo *git.Repository) error {
+	if err := repo.DeleteRemote(targetRemoteName); err != nil && err != git.ErrRemoteNotFound {
+		return err
+	}
+	refs, err := repo.References()
+	if err != nil {
+		return err
+	}
+	prefix := "refs/remotes/" + targetRemoteName + "/"
+	return refs.ForEach(func(ref *plumbing.Reference) error {
+		if !strings.HasPrefix(ref.Name().String(), prefix) {
+			return nil
+		}
+		return repo.Storer.RemoveReference(ref.Name())
+	})
+}
+
+// isGitHubURL returns whether the remote URL is served over HTTPS by github.com.
+func isGitHubURL(remoteURL string) bool {
+	u, err := url.Parse(remoteURL)
+	return err == nil && u.Scheme == "https" && u.Hostname() == "github.com"
+}
+
 type commander struct {
 	verbose bool
 	ctx     context.Context
 }
 
 func (c *commander) exec(command ...string) (string, error) {
+	if c.verbose {
+		// All to stdout.
+		return c.execStream(os.Stdout, command...)
+	}
+	return c.execStream(nil, command...)
+}
+
+// execStream runs the command and returns its output, which is also
+// written to w while the command runs if w is not nil.
+// The output is returned even if the command fails.
+func (c *commander) execStream(w io.Writer, command ...string) (string, error) {
 	cmd := exec.CommandContext(c.ctx, command[0], command[1:]...)
 	var b bytes.Buffer
 	cmd.Stdout = &b
-	cmd.Stderr = &b
-
-	if c.verbose {
-		// All to stdout.
-		cmd.Stdout = io.MultiWriter(cmd.Stdout, os.Stdout)
-		cmd.Stderr = io.MultiWriter(cmd.Stdout, os.Stdout)
+	if w != nil {
+		cmd.Stdout = io.MultiWriter(&b, w)
 	}
+	cmd.Stderr = cmd.Stdout
+
 	if err := cmd.Run(); err != nil {
 		out := b.String()
-		return "", errors.Errorf("error: %v; Command out: %s", err, out)
+		return out, errors.Errorf("error: %v; Command out: %s", err, out)
 	}
 
 	return b.String(), nil
@@ -14,6 +14,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 
 	fixtures "github.com/go-git/go-git-fixtures/v4"
@@ -47,3 +56,211 @@ func TestGetTargetInfo(t *testing.T) {
 		}
 	}
 }
+
+func TestCommanderExecStream(t *testing.T) {
+	c := &commander{ctx: context.Background()}
+
+	var streamed bytes.Buffer
+	out, err := c.execStream(&streamed, "sh", "-c", "echo BenchmarkFoo-4; echo warning >&2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "BenchmarkFoo-4\nwarning\n"
+	if out != expected {
+		t.Errorf("Expected captured output %q, got %q", expected, out)
+	}
+	if streamed.String() != expected {
+		t.Errorf("Expected streamed output %q, got %q", expected, streamed.String())
+	}
+}
+
+func TestFetchTargetRemote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_target_remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := fixtures.Basic().One().DotGit().Root()
+	defaultBranch, err := fetchTargetRemote(context.Background(), r, upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if defaultBranch != "master" {
+		t.Errorf("expected default branch master, got %s", defaultBranch)
+	}
+
+	remote, err := r.Remote(targetRemoteName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if urls := remote.Config().URLs; len(urls) != 1 || urls[0] != upstream {
+		t.Errorf("expected remote %s with URL %s, got %v", targetRemoteName, upstream, urls)
+	}
+
+	commit := getTargetInfo(r, targetRemoteName+"/branch")
+	if expected := "e8d3ffab552895c19b9fcf7aa264d277cde33881"; commit.String() != expected {
+		t.Errorf("error when get target %s/branch, expect %s, got %s", targetRemoteName, expected, commit)
+	}
+
+	// Tags are fetched apart from the tags of the repository.
+	if commit := getTargetInfo(r, targetRemoteName+"/tags/v1.0.0"); commit == plumbing.ZeroHash {
+		t.Errorf("expected tag v1.0.0 of the target remote")
+	}
+	if _, err := r.Tag("v1.0.0"); err != git.ErrTagNotFound {
+		t.Errorf("expected the tags of the repository to be left alone, got %v", err)
+	}
+
+	// Fetching again replaces the remote.
+	if _, err := fetchTargetRemote(context.Background(), r, upstream); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeTargetRemote(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Remote(targetRemoteName); err != git.ErrRemoteNotFound {
+		t.Errorf("expected the remote to be removed, got %v", err)
+	}
+	if commit := getTargetInfo(r, targetRemoteName+"/branch"); commit != plumbing.ZeroHash {
+		t.Errorf("expected the references of the remote to be removed, got %s", commit)
+	}
+}
+
+func TestIsGitHubURL(t *testing.T) {
+	for remoteURL, expected := range map[string]bool{
+		"https://github.com/prometheus/prometheus.git": true,
+		"https://github.com.example.com/prometheus":    false,
+		"https://gitlab.com/prometheus/prometheus.git": false,
+		"http://github.com/prometheus/prometheus.git":  false,
+		"/tmp/prometheus": false,
+	} {
+		if got := isGitHubURL(remoteURL); got != expected {
+			t.Errorf("expected %v for %s, got %v", expected, remoteURL, got)
+		}
+	}
+}
+
+func TestCommitSubject(t *testing.T) {
+	f := fixtures.Basic().One()
+	sto := filesystem.NewStorage(f.DotGit(), cache.NewObjectLRUDefault())
+	r, err := git.Open(sto, f.DotGit())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]string{
+		"6ecf0ef2c2dffb796033e5a02219af86ec6584e5": "vendor stuff",
+		plumbing.ZeroHash.String():                 "",
+	}
+	for hash, expected := range testCases {
+		if s := commitSubject(r, plumbing.NewHash(hash)); s != expected {
+			t.Errorf("error when get subject of %s, expect %q, got %q", hash, expected, s)
+		}
+	}
+}
+
+func TestRunnerInfo(t *testing.T) {
+	info := runnerInfo("go1.15")
+	expected := fmt.Sprintf("Environment: %s/%s, %d CPUs, go1.15", runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
+	if info != expected {
+		t.Errorf("Expected %q, got %q", expected, info)
+	}
+	if strings.Contains(info, "\n") {
+		t.Errorf("Expected a single line, got %q", info)
+	}
+
+	if v := goVersion(&commander{ctx: context.Background()}); !strings.HasPrefix(v, "go") {
+		t.Errorf("Expected a go version, got %q", v)
+	}
+}
+
+func TestStartBenchmarkKeepWorktree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_keep_worktree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repoDir := filepath.Join(dir, "repo")
+	if err := os.Mkdir(repoDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(repoDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	c := &commander{ctx: context.Background()}
+	commit := func(result string) {
+		if err := ioutil.WriteFile("bench.txt", []byte(result), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, cmd := range [][]string{
+			{"git", "add", "bench.txt"},
+			{"git", "-c", "user.name=funcbench", "-c", "user.email=funcbench@example.com", "commit", "-q", "-m", "bench"},
+		} {
+			if _, err := c.exec(cmd...); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := c.exec("git", "init", "-q"); err != nil {
+		t.Fatal(err)
+	}
+	commit("BenchmarkFoo-4	1000	1000 ns/op\n")
+	if _, err := c.exec("git", "branch", "old"); err != nil {
+		t.Fatal(err)
+	}
+	commit("BenchmarkFoo-4	1000	900 ns/op\n")
+
+	l := log.New(ioutil.Discard, "", 0)
+	env, err := newLocalEnv(environment{logger: l, benchFunc: "BenchmarkFoo", compareTarget: "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Benchmarker{
+		logger:         l,
+		benchFunc:      "BenchmarkFoo",
+		benchmarkArgs:  []string{"cat", "bench.txt"},
+		resultCacheDir: dir,
+		c:              c,
+		repo:           env.Repo(),
+		stream:         ioutil.Discard,
+	}
+	wtDir := filepath.Join(repoDir, "_funcbench-cmp")
+
+	if _, _, err := startBenchmark(env, b, "_funcbench-cmp", "", true, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(wtDir, "bench.txt")); err != nil {
+		t.Errorf("Expected the worktree at %s to be kept, got %v", wtDir, err)
+	}
+	if out, _ := c.exec("git", "worktree", "list"); !strings.Contains(out, "_funcbench-cmp") {
+		t.Errorf("Expected the worktree at %s to be registered, got:\n%s", wtDir, out)
+	}
+
+	// Changes made while debugging don't prevent the removal.
+	if err := ioutil.WriteFile(filepath.Join(wtDir, "bench.txt"), []byte("debug"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := startBenchmark(env, b, "_funcbench-cmp", "", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(wtDir); !os.IsNotExist(err) {
+		t.Errorf("Expected the worktree at %s to be removed, got %v", wtDir, err)
+	}
+	if out, _ := c.exec("git", "worktree", "list"); strings.Contains(out, "_funcbench-cmp") {
+		t.Errorf("Expected the worktree at %s to be pruned, got:\n%s", wtDir, out)
+	}
+}
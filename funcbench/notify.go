@@ -0,0 +1,72 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/perf/benchstat"
+)
+
+// completionSummary returns a short summary of the results to notify about,
+// linking to the comment with the results in GitHub mode.
+func completionSummary(env Environment, tables []*benchstat.Table) string {
+	return notifySummary(env, "finished", summarizeTables(tables), "Results")
+}
+
+// failureSummary returns a short summary of the error of the run to notify about,
+// linking to the comment with the error in GitHub mode.
+func failureSummary(env Environment, err error) string {
+	return notifySummary(env, "failed", err.Error(), "Details")
+}
+
+// notifySummary returns the summary of a run with the given status, linking to the comment of the run in GitHub mode.
+func notifySummary(env Environment, status, text, linkTitle string) string {
+	g, ok := env.(*GitHub)
+	if !ok {
+		return fmt.Sprintf("funcbench %s comparing against %s:\n%s", status, env.CompareTarget(), text)
+	}
+
+	summary := fmt.Sprintf("funcbench %s comparing %s/%s#%d against %s:\n%s",
+		status, g.client.owner, g.client.repo, g.client.prNumber, g.CompareTarget(), text)
+	if g.client.commentURL != "" {
+		summary += "\n" + linkTitle + ": " + g.client.commentURL
+	}
+	return summary
+}
+
+// notify posts the text to a webhook accepting a JSON object with a text field, eg. a Slack incoming webhook.
+func notify(url, text string) error {
+	body, err := json.Marshal(struct {
+		Text string `json:"text"`
+	}{text})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-github/v29/github"
+	"github.com/pkg/errors"
+	"golang.org/x/perf/benchstat"
+)
+
+func TestNotify(t *testing.T) {
+	var payload struct {
+		Text string `json:"text"`
+	}
+	status := http.StatusOK
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/prometheus/prometheus/issues/35/comments", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode([]*github.IssueComment{})
+		case http.MethodPost:
+			c := &github.IssueComment{}
+			json.NewDecoder(r.Body).Decode(c)
+			c.HTMLURL = github.String("https://github.com/prometheus/prometheus/pull/35#issuecomment-1")
+			json.NewEncoder(w).Encode(c)
+		}
+	})
+	mux.HandleFunc("/webhook", func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Expected a JSON payload, got %s", ct)
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(status)
+	})
+	client, srv := newTestGitHubClient(mux)
+	defer srv.Close()
+	g := &GitHub{
+		environment: environment{compareTarget: "master"},
+		client:      client,
+	}
+
+	c := &benchstat.Collection{DeltaTest: benchstat.NoDeltaTest}
+	c.AddConfig("old", []byte("BenchmarkRespond-4	710	1691189 ns/op\nBenchmarkParse-4	510378	2388 ns/op"))
+	c.AddConfig("new", []byte("BenchmarkRespond-4	688	1500000 ns/op\nBenchmarkParse-4	510378	2388 ns/op"))
+	tables := c.Tables()
+	if err := g.PostResults(tables); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := notify(srv.URL+"/webhook", completionSummary(g, tables)); err != nil {
+		t.Fatal(err)
+	}
+	expected := `funcbench finished comparing prometheus/prometheus#35 against master:
+time/op: 1 better, 0 worse, 1 unchanged
+Results: https://github.com/prometheus/prometheus/pull/35#issuecomment-1`
+	if payload.Text != expected {
+		t.Errorf("Expected payload:\n%s\ngot:\n%s", expected, payload.Text)
+	}
+
+	if err := g.PostErr("benchmark timed out"); err != nil {
+		t.Fatal(err)
+	}
+	if err := notify(srv.URL+"/webhook", failureSummary(g, errors.New("benchmark timed out"))); err != nil {
+		t.Fatal(err)
+	}
+	expected = `funcbench failed comparing prometheus/prometheus#35 against master:
+benchmark timed out
+Details: https://github.com/prometheus/prometheus/pull/35#issuecomment-1`
+	if payload.Text != expected {
+		t.Errorf("Expected payload:\n%s\ngot:\n%s", expected, payload.Text)
+	}
+
+	status = http.StatusInternalServerError
+	if err := notify(srv.URL+"/webhook", "summary"); err == nil {
+		t.Error("Expected an error for a failed webhook")
+	}
+}
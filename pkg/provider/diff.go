@@ -0,0 +1,145 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ObjectFetcher fetches the currently applied state of an object.
+type ObjectFetcher interface {
+	// Fetch returns the live content of the object defined by the rendered content,
+	// or nil if the object doesn't exist.
+	Fetch(fileName string, content []byte) ([]byte, error)
+}
+
+// ResourceDiff holds the differences between a rendered resource file and the live objects.
+type ResourceDiff struct {
+	FileName string
+	Diff     string
+}
+
+// DiffResources compares every object of the resources, as split by the Separator,
+// with its live state and returns the resources having differences.
+func DiffResources(resources []Resource, fetcher ObjectFetcher) ([]ResourceDiff, error) {
+	var diffs []ResourceDiff
+	for _, r := range resources {
+		var diff strings.Builder
+		for _, text := range strings.Split(string(r.Content), Separator) {
+			text = strings.TrimSpace(text)
+			if len(text) == 0 {
+				continue
+			}
+
+			live, err := fetcher.Fetch(r.FileName, []byte(text))
+			if err != nil {
+				return nil, fmt.Errorf("error fetching live object of file %s: %v", r.FileName, err)
+			}
+			diff.WriteString(diffLines(strings.TrimSpace(string(live)), text))
+		}
+		if diff.Len() > 0 {
+			diffs = append(diffs, ResourceDiff{
+				FileName: r.FileName,
+				Diff:     fmt.Sprintf("--- live/%s\n+++ rendered/%s\n%s", r.FileName, r.FileName, diff.String()),
+			})
+		}
+	}
+	return diffs, nil
+}
+
+// diffLines returns the line by line differences between a and b,
+// or an empty string if they are the same.
+func diffLines(a, b string) string {
+	if a == b {
+		return ""
+	}
+	var al, bl []string
+	if a != "" {
+		al = strings.Split(a, "\n")
+	}
+	if b != "" {
+		bl = strings.Split(b, "\n")
+	}
+
+	// Lines common to the start and the end of both sides, eg. most of a large
+	// dashboard with a few changed lines, don't need the longest common subsequence.
+	var prefix, suffix int
+	for prefix < len(al) && prefix < len(bl) && al[prefix] == bl[prefix] {
+		prefix++
+	}
+	for suffix < len(al)-prefix && suffix < len(bl)-prefix && al[len(al)-1-suffix] == bl[len(bl)-1-suffix] {
+		suffix++
+	}
+
+	var out strings.Builder
+	for _, l := range al[:prefix] {
+		out.WriteString(" " + l + "\n")
+	}
+	diffChangedLines(&out, al[prefix:len(al)-suffix], bl[prefix:len(bl)-suffix])
+	for _, l := range al[len(al)-suffix:] {
+		out.WriteString(" " + l + "\n")
+	}
+	return out.String()
+}
+
+// maxDiffCells limits the size of the table of the longest common subsequence of the changed lines.
+const maxDiffCells = 1 << 20
+
+// diffChangedLines writes the line by line differences between al and bl to out.
+// When there are too many changed lines to compare, all of them are shown as replaced.
+func diffChangedLines(out *strings.Builder, al, bl []string) {
+	if (len(al)+1)*(len(bl)+1) > maxDiffCells {
+		for _, l := range al {
+			out.WriteString("-" + l + "\n")
+		}
+		for _, l := range bl {
+			out.WriteString("+" + l + "\n")
+		}
+		return
+	}
+
+	// Longest common subsequence of the lines.
+	lcs := make([][]int, len(al)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bl)+1)
+	}
+	for i := len(al) - 1; i >= 0; i-- {
+		for j := len(bl) - 1; j >= 0; j-- {
+			if al[i] == bl[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(al) || j < len(bl) {
+		switch {
+		case i < len(al) && j < len(bl) && al[i] == bl[j]:
+			out.WriteString(" " + al[i] + "\n")
+			i++
+			j++
+		case i < len(al) && (j == len(bl) || lcs[i+1][j] >= lcs[i][j+1]):
+			out.WriteString("-" + al[i] + "\n")
+			i++
+		default:
+			out.WriteString("+" + bl[j] + "\n")
+			j++
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type fakeFetcher map[string]string
+
+func (f fakeFetcher) Fetch(_ string, content []byte) ([]byte, error) {
+	name := strings.SplitN(string(content), "\n", 2)[0]
+	if live, ok := f[name]; ok {
+		return []byte(live), nil
+	}
+	return nil, nil
+}
+
+func TestDiffResources(t *testing.T) {
+	resources := []Resource{
+		{
+			FileName: "1_namespace.yaml",
+			Content:  []byte("name: prombench\nkind: Namespace\n"),
+		},
+		{
+			FileName: "2_deployment.yaml",
+			Content:  []byte("name: prometheus\nkind: Deployment\nreplicas: 2\n---\nname: loadgen\nkind: Deployment\n"),
+		},
+	}
+	fetcher := fakeFetcher{
+		"name: prombench":  "name: prombench\nkind: Namespace\n",
+		"name: prometheus": "name: prometheus\nkind: Deployment\nreplicas: 1\n",
+	}
+
+	diffs, err := DiffResources(resources, fetcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 {
+		t.Fatalf("expected 1 resource with differences, got %d", len(diffs))
+	}
+
+	expected := `--- live/2_deployment.yaml
++++ rendered/2_deployment.yaml
+ name: prometheus
+ kind: Deployment
+-replicas: 1
++replicas: 2
++name: loadgen
++kind: Deployment
+`
+	if diffs[0].FileName != "2_deployment.yaml" || diffs[0].Diff != expected {
+		t.Errorf("\nexpect %s\ngot %s", expected, diffs[0].Diff)
+	}
+}
+
+func TestDiffLinesLarge(t *testing.T) {
+	lines := func(prefix string, n int) []string {
+		l := make([]string, n)
+		for i := range l {
+			l[i] = fmt.Sprintf("%s%d", prefix, i)
+		}
+		return l
+	}
+
+	// A few changed lines of a large file are compared line by line.
+	live := lines("line", 6000)
+	rendered := append([]string{}, live...)
+	rendered[3000] = "changed"
+	diff := diffLines(strings.Join(live, "\n"), strings.Join(rendered, "\n"))
+	if !strings.Contains(diff, " line2999\n-line3000\n+changed\n line3001\n") {
+		t.Errorf("expected the changed line in the diff")
+	}
+	if n := strings.Count(diff, "\n"); n != 6001 {
+		t.Errorf("expected 6001 lines in the diff, got %d", n)
+	}
+
+	// Too many changed lines are all shown as replaced.
+	live, rendered = lines("old", 2000), lines("new", 2000)
+	expected := "-" + strings.Join(live, "\n-") + "\n+" + strings.Join(rendered, "\n+") + "\n"
+	if diff := diffLines(strings.Join(live, "\n"), strings.Join(rendered, "\n")); diff != expected {
+		t.Errorf("expected all lines to be replaced")
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// ApplyPatches applies strategic merge patches to the objects of the resources,
+// as split by the Separator, and returns the patched resources.
+// The patches are keyed by the kind and name of the patched object, eg. "Deployment/prometheus-test".
+// Every patch has to match at least one object.
+func ApplyPatches(resources []Resource, patches map[string][]byte) ([]Resource, error) {
+	matched := map[string]bool{}
+	res := make([]Resource, 0, len(resources))
+	for _, r := range resources {
+		docs := strings.Split(string(r.Content), Separator)
+		for i, text := range docs {
+			m := objectsMetadata([]byte(text))
+			if len(m) == 0 {
+				continue
+			}
+			key := m[0].Kind + "/" + m[0].Name
+			patch, ok := patches[key]
+			if !ok {
+				continue
+			}
+			matched[key] = true
+
+			out, err := strategicMergePatch(m[0], []byte(text), patch)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't patch %s in file %s: %v", key, r.FileName, err)
+			}
+			if i > 0 {
+				out = append([]byte("\n"), out...)
+			}
+			docs[i] = string(out)
+		}
+
+		content := []byte(strings.Join(docs, Separator))
+		res = append(res, Resource{
+			FileName: r.FileName,
+			Content:  content,
+			Metadata: objectsMetadata(content),
+		})
+	}
+
+	for key := range patches {
+		if !matched[key] {
+			return nil, fmt.Errorf("patch %s doesn't match any object", key)
+		}
+	}
+	return res, nil
+}
+
+// strategicMergePatch applies the yaml patch to the yaml object, using the schema
+// of its kind to merge lists, eg. the containers by their name.
+func strategicMergePatch(m ObjectMetadata, original, patch []byte) ([]byte, error) {
+	obj, err := scheme.Scheme.New(schema.FromAPIVersionAndKind(m.APIVersion, m.Kind))
+	if err != nil {
+		return nil, err
+	}
+
+	originalJSON, err := k8syaml.ToJSON(original)
+	if err != nil {
+		return nil, err
+	}
+	patchJSON, err := k8syaml.ToJSON(patch)
+	if err != nil {
+		return nil, fmt.Errorf("invalid patch: %v", err)
+	}
+	patched, err := strategicpatch.StrategicMergePatch(originalJSON, patchJSON, obj)
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON is valid yaml, decode it to write it back as yaml.
+	var out yaml.MapSlice
+	if err := yaml.Unmarshal(patched, &out); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(out)
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"strings"
+	"testing"
+)
+
+const overlayDeployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: prometheus-test
+spec:
+  template:
+    spec:
+      containers:
+      - name: prometheus
+        image: prom/prometheus:master
+        resources:
+          requests:
+            cpu: "1"
+      - name: config-reloader
+        image: jimmidyson/configmap-reload:v0.3.0
+`
+
+func TestApplyPatches(t *testing.T) {
+	resources := []Resource{{
+		FileName: "prometheus.yaml",
+		Content:  []byte(overlayDeployment + "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: prometheus-test\n"),
+	}}
+	patches := map[string][]byte{
+		"Deployment/prometheus-test": []byte(`spec:
+  template:
+    spec:
+      containers:
+      - name: prometheus
+        resources:
+          requests:
+            cpu: "4"
+            memory: 8Gi
+`),
+	}
+
+	patched, err := ApplyPatches(resources, patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := string(patched[0].Content)
+	docs := strings.Split(content, Separator)
+	if len(docs) != 2 {
+		t.Fatalf("expect 2 objects, got:\n%s", content)
+	}
+	for _, expected := range []string{
+		"cpu: \"4\"",
+		"memory: 8Gi",
+		"image: prom/prometheus:master",
+		// The other container is kept.
+		"name: config-reloader",
+	} {
+		if !strings.Contains(docs[0], expected) {
+			t.Errorf("expect %q in the patched deployment, got:\n%s", expected, docs[0])
+		}
+	}
+	if docs[1] != "\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: prometheus-test\n" {
+		t.Errorf("expect the config map to be unchanged, got:\n%s", docs[1])
+	}
+	if len(patched[0].Metadata) != 2 {
+		t.Errorf("expect metadata of 2 objects, got %+v", patched[0].Metadata)
+	}
+
+	if _, err := ApplyPatches(resources, map[string][]byte{"Deployment/loadgen": []byte("spec: {}")}); err == nil {
+		t.Error("expect an error for a patch not matching any object")
+	}
+}
@@ -14,15 +14,25 @@
 package provider
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"text/template"
+	"text/template/parse"
 	"time"
+
+	"gopkg.in/yaml.v2"
 )
 
 const (
@@ -60,6 +70,88 @@ func NewDeploymentResource() *DeploymentResource {
 type Resource struct {
 	FileName string
 	Content  []byte
+	// Metadata of the objects in Content, best effort as Content is authoritative.
+	Metadata []ObjectMetadata
+}
+
+// Checksum returns the hex encoded SHA-256 checksum of the content.
+func (r Resource) Checksum() string {
+	sum := sha256.Sum256(r.Content)
+	return hex.EncodeToString(sum[:])
+}
+
+// ObjectMetadata holds the fields identifying a k8s object.
+type ObjectMetadata struct {
+	APIVersion string
+	Kind       string
+	Name       string
+	Namespace  string
+}
+
+// objectsMetadata returns the metadata of the objects in the content, as split by the Separator.
+// Objects which can't be decoded or don't have a kind are skipped.
+func objectsMetadata(content []byte) []ObjectMetadata {
+	var res []ObjectMetadata
+	for _, text := range strings.Split(string(content), Separator) {
+		var o struct {
+			APIVersion string `yaml:"apiVersion"`
+			Kind       string `yaml:"kind"`
+			Metadata   struct {
+				Name      string `yaml:"name"`
+				Namespace string `yaml:"namespace"`
+			} `yaml:"metadata"`
+		}
+		if err := yaml.Unmarshal([]byte(text), &o); err != nil || o.Kind == "" {
+			continue
+		}
+		res = append(res, ObjectMetadata{
+			APIVersion: o.APIVersion,
+			Kind:       o.Kind,
+			Name:       o.Metadata.Name,
+			Namespace:  o.Metadata.Namespace,
+		})
+	}
+	return res
+}
+
+// UnknownKind is the GroupByKind bucket of the objects without a kind.
+const UnknownKind = ""
+
+// GroupByKind splits the resources into single objects and returns them grouped by their kind,
+// keeping the order of the input within a kind. The items of lists are grouped as single objects.
+func GroupByKind(resources []Resource) map[string][]Resource {
+	res := map[string][]Resource{}
+	add := func(fileName string, content []byte) {
+		m := objectsMetadata(content)
+		kind := UnknownKind
+		if len(m) > 0 {
+			kind = m[0].Kind
+		}
+		res[kind] = append(res[kind], Resource{FileName: fileName, Content: content, Metadata: m})
+	}
+
+	for _, r := range resources {
+		for _, text := range strings.Split(string(r.Content), Separator) {
+			if strings.TrimSpace(text) == "" {
+				continue
+			}
+
+			var list struct {
+				Kind  string          `yaml:"kind"`
+				Items []yaml.MapSlice `yaml:"items"`
+			}
+			if err := yaml.Unmarshal([]byte(text), &list); err != nil || !strings.HasSuffix(list.Kind, "List") {
+				add(r.FileName, []byte(strings.TrimLeft(text, "\n")))
+				continue
+			}
+			for _, item := range list.Items {
+				// Items decoded from yaml can always be encoded back.
+				content, _ := yaml.Marshal(item)
+				add(r.FileName, content)
+			}
+		}
+	}
+	return res
 }
 
 // RetryUntilTrue returns when there is an error or the requested operation returns true.
@@ -78,33 +170,123 @@ func RetryUntilTrue(name string, retryCount int, fn func() (bool, error)) error
 	return fmt.Errorf("Request for '%v' hasn't completed after retrying %d times", name, retryCount)
 }
 
-// applyTemplateVars applies golang templates to deployment files.
-func applyTemplateVars(content []byte, deploymentVars map[string]string) ([]byte, error) {
-	fileContentParsed := bytes.NewBufferString("")
-	t := template.New("resource").Option("missingkey=error")
-	t = t.Funcs(template.FuncMap{
+// maxIncludeDepth limits the nesting of included partials, to stop include cycles.
+const maxIncludeDepth = 10
+
+// templateFuncs returns the functions available to the templates of the deployment files in dir,
+// included at the given depth.
+func templateFuncs(dir string, depth int) template.FuncMap {
+	return template.FuncMap{
 		// k8s objects can't have dots(.) se we add a custom function to allow normalising the variable values.
 		"normalise": func(t string) string {
 			return strings.Replace(t, ".", "-", -1)
 		},
+		// normaliseName converts the value to a valid RFC 1123 label name.
+		"normaliseName": normaliseName,
 		"split": func(rangeVars, separator string) []string {
 			return strings.Split(rangeVars, separator)
 		},
-	})
+		// file returns the content of a file relative to the directory of the deployment file.
+		"file": func(name string) (string, error) {
+			path, err := templateFile(dir, name)
+			if err != nil {
+				return "", err
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
+			return string(content), nil
+		},
+		// include renders a partial template relative to the directory of the deployment file with the data.
+		// Partials kept in a partials directory aren't parsed as deployment files when parsing a directory.
+		"include": func(name string, data interface{}) (string, error) {
+			if depth >= maxIncludeDepth {
+				return "", fmt.Errorf("including %s exceeds the maximum include depth of %d, the includes might be cyclic", name, maxIncludeDepth)
+			}
+			path, err := templateFile(dir, name)
+			if err != nil {
+				return "", err
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
+			t, err := template.New(name).Option("missingkey=error").Funcs(templateFuncs(filepath.Dir(path), depth+1)).Parse(string(content))
+			if err != nil {
+				return "", err
+			}
+			var buf bytes.Buffer
+			if err := t.Execute(&buf, data); err != nil {
+				return "", err
+			}
+			return buf.String(), nil
+		},
+	}
+}
+
+// templateFile returns the path of a file used by a template, which has to be within dir.
+func templateFile(dir, name string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(absDir, name)
+	if !strings.HasPrefix(path, absDir+string(filepath.Separator)) {
+		return "", fmt.Errorf("file %s is outside of %s", name, dir)
+	}
+	return path, nil
+}
+
+var invalidNameCharsRe = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// normaliseName lowercases the value, replaces any run of characters not allowed
+// in a RFC 1123 label with a dash and truncates it to 63 characters.
+func normaliseName(t string) string {
+	t = invalidNameCharsRe.ReplaceAllString(strings.ToLower(t), "-")
+	t = strings.Trim(t, "-")
+	if len(t) > 63 {
+		t = strings.TrimRight(t[:63], "-")
+	}
+	return t
+}
+
+// applyTemplateVars applies golang templates to deployment files in dir.
+func applyTemplateVars(dir string, content []byte, deploymentVars map[string]string) ([]byte, error) {
+	fileContentParsed := bytes.NewBufferString("")
+	t := template.New("resource").Option("missingkey=error")
+	t = t.Funcs(templateFuncs(dir, 0))
 	if err := template.Must(t.Parse(string(content))).Execute(fileContentParsed, deploymentVars); err != nil {
 		return nil, fmt.Errorf("Failed to execute parse file err: %s", err)
 	}
 	return fileContentParsed.Bytes(), nil
 }
 
-// DeploymentsParse parses the deployment files and returns the result as bytes grouped by the filename.
-// Any variables passed to the cli will be replaced in the resources files following the golang text template format.
-func DeploymentsParse(deploymentFiles []string, deploymentVars map[string]string) ([]Resource, error) {
+// gunzip returns the decompressed content of gzip data.
+func gunzip(content []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// partialsDir is the name of the directories holding the partials to include,
+// which aren't deployment files themselves.
+const partialsDir = "partials"
+
+// deploymentFileList returns the deployment files, expanding directories to the yaml files in them
+// except for the ones in partials directories.
+func deploymentFileList(deploymentFiles []string) ([]string, error) {
 	var fileList []string
 	for _, name := range deploymentFiles {
 		if file, err := os.Stat(name); err == nil && file.IsDir() {
 			if err := filepath.Walk(name, func(path string, f os.FileInfo, err error) error {
-				if filepath.Ext(path) == ".yaml" || filepath.Ext(path) == ".yml" {
+				if f != nil && f.IsDir() && f.Name() == partialsDir && path != name {
+					return filepath.SkipDir
+				}
+				if isDeploymentFile(path) {
 					fileList = append(fileList, path)
 				}
 				return nil
@@ -115,24 +297,460 @@ func DeploymentsParse(deploymentFiles []string, deploymentVars map[string]string
 			fileList = append(fileList, name)
 		}
 	}
+	return fileList, nil
+}
+
+// isDeploymentFile returns whether the file has a yaml extension, optionally gzipped.
+func isDeploymentFile(name string) bool {
+	ext := filepath.Ext(strings.TrimSuffix(name, ".gz"))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// readDeploymentFile returns the content of a deployment file and its name.
+// Gzipped files are read as their decompressed content with the .gz suffix removed from the name.
+func readDeploymentFile(name string) ([]byte, string, error) {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading file %v:%v", name, err)
+	}
+	if strings.HasSuffix(name, ".gz") {
+		content, err = gunzip(content)
+		if err != nil {
+			return nil, "", fmt.Errorf("couldn't decompress file %s: %v", name, err)
+		}
+		name = strings.TrimSuffix(name, ".gz")
+	}
+	return content, name, nil
+}
+
+// noParse returns whether the file has the suffix "noparse" and shouldn't be parsed as a template.
+func noParse(name string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(filepath.Base(name), filepath.Ext(name)), "noparse")
+}
+
+// ParseOption configures DeploymentsParse.
+type ParseOption func(*parseOptions)
+
+type parseOptions struct {
+	labels      map[string]string
+	annotations map[string]string
+	fileVars    map[string]map[string]string
+	strict      bool
+}
+
+// WithFileVars sets variables for the files matching a glob, eg. "*_deployment.yaml",
+// which take precedence over the deployment variables for those files.
+// The glob is matched against the file name and its full path.
+// When multiple globs match, they are applied in lexical order.
+func WithFileVars(fileVars map[string]map[string]string) ParseOption {
+	return func(o *parseOptions) {
+		o.fileVars = fileVars
+	}
+}
+
+// varsForFile returns the deployment variables merged with the variables of the globs matching the file.
+func (o *parseOptions) varsForFile(name string, deploymentVars map[string]string) (map[string]string, error) {
+	globs := make([]string, 0, len(o.fileVars))
+	for g := range o.fileVars {
+		globs = append(globs, g)
+	}
+	sort.Strings(globs)
+
+	vars := []map[string]string{deploymentVars}
+	for _, g := range globs {
+		matchBase, err := filepath.Match(g, filepath.Base(name))
+		if err != nil {
+			return nil, fmt.Errorf("invalid file glob %q: %v", g, err)
+		}
+		matchPath, _ := filepath.Match(g, name)
+		if matchBase || matchPath {
+			vars = append(vars, o.fileVars[g])
+		}
+	}
+	return MergeDeploymentVars(vars...), nil
+}
+
+// WithStrictRender makes a template which renders to nothing but whitespace an error,
+// instead of only logging a warning, as it usually means a resource was dropped by mistake.
+func WithStrictRender() ParseOption {
+	return func(o *parseOptions) {
+		o.strict = true
+	}
+}
+
+// WithCommonMetadata injects the labels and annotations into the metadata of every k8s object,
+// eg. app.kubernetes.io/managed-by for server-side apply.
+// Labels and annotations already set by the object are kept.
+func WithCommonMetadata(labels, annotations map[string]string) ParseOption {
+	return func(o *parseOptions) {
+		o.labels = labels
+		o.annotations = annotations
+	}
+}
+
+// injectMetadata merges the labels and annotations into the metadata of the objects in the content,
+// as split by the Separator. Anything which isn't a k8s object is left untouched.
+func injectMetadata(content []byte, labels, annotations map[string]string) ([]byte, error) {
+	docs := strings.Split(string(content), Separator)
+	for i, text := range docs {
+		var o yaml.MapSlice
+		if err := yaml.Unmarshal([]byte(text), &o); err != nil || mapSliceValue(o, "kind") == nil {
+			continue
+		}
+
+		metadata, _ := mapSliceValue(o, "metadata").(yaml.MapSlice)
+		metadata = mergeMapSlice(metadata, "labels", labels)
+		metadata = mergeMapSlice(metadata, "annotations", annotations)
+		o = setMapSliceValue(o, "metadata", metadata)
+
+		out, err := yaml.Marshal(o)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			out = append([]byte("\n"), out...)
+		}
+		docs[i] = string(out)
+	}
+	return []byte(strings.Join(docs, Separator)), nil
+}
+
+// mergeMapSlice adds the values to the map under key in m, unless already set.
+func mergeMapSlice(m yaml.MapSlice, key string, values map[string]string) yaml.MapSlice {
+	if len(values) == 0 {
+		return m
+	}
+	existing, _ := mapSliceValue(m, key).(yaml.MapSlice)
+
+	names := make([]string, 0, len(values))
+	for k := range values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if mapSliceValue(existing, k) == nil {
+			existing = append(existing, yaml.MapItem{Key: k, Value: values[k]})
+		}
+	}
+	return setMapSliceValue(m, key, existing)
+}
+
+func mapSliceValue(m yaml.MapSlice, key string) interface{} {
+	for _, item := range m {
+		if item.Key == key {
+			return item.Value
+		}
+	}
+	return nil
+}
+
+func setMapSliceValue(m yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	for i, item := range m {
+		if item.Key == key {
+			m[i].Value = value
+			return m
+		}
+	}
+	return append(m, yaml.MapItem{Key: key, Value: value})
+}
+
+// DeploymentsParse parses the deployment files and returns the result as bytes grouped by the filename.
+// Any variables passed to the cli will be replaced in the resources files following the golang text template format.
+func DeploymentsParse(deploymentFiles []string, deploymentVars map[string]string, opts ...ParseOption) ([]Resource, error) {
+	var o parseOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	fileList, err := deploymentFileList(deploymentFiles)
+	if err != nil {
+		return nil, err
+	}
 
 	deploymentObjects := make([]Resource, 0)
 	for _, name := range fileList {
-		absFileName := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
-		content, err := ioutil.ReadFile(name)
+		r, err := parseDeploymentFile(name, deploymentVars, o)
 		if err != nil {
-			log.Fatalf("Error reading file %v:%v", name, err)
+			return nil, err
 		}
-		// Don't parse file with the suffix "noparse".
-		if !strings.HasSuffix(absFileName, "noparse") {
-			content, err = applyTemplateVars(content, deploymentVars)
-			if err != nil {
-				return nil, fmt.Errorf("couldn't apply template to file %s: %v", name, err)
+		deploymentObjects = append(deploymentObjects, r)
+	}
+	return deploymentObjects, nil
+}
+
+// DeploymentsParseChanged parses the deployment files like DeploymentsParse, but only returns the resources
+// whose checksum differs from the one in previousChecksums, keyed by the file name, along with the checksums
+// of all the parsed resources to pass on the next call.
+// Files which were removed since are left out of the returned checksums.
+func DeploymentsParseChanged(deploymentFiles []string, deploymentVars map[string]string, previousChecksums map[string]string, opts ...ParseOption) ([]Resource, map[string]string, error) {
+	resources, err := DeploymentsParse(deploymentFiles, deploymentVars, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changed := make([]Resource, 0)
+	checksums := make(map[string]string, len(resources))
+	for _, r := range resources {
+		checksums[r.FileName] = r.Checksum()
+		if previousChecksums[r.FileName] != checksums[r.FileName] {
+			changed = append(changed, r)
+		}
+	}
+	return changed, checksums, nil
+}
+
+// DeploymentParseFile parses a single deployment file the same way as DeploymentsParse.
+func DeploymentParseFile(name string, deploymentVars map[string]string, opts ...ParseOption) (Resource, error) {
+	if !isDeploymentFile(name) {
+		return Resource{}, fmt.Errorf("file %s doesn't have a .yaml or .yml extension", name)
+	}
+	if _, err := os.Stat(name); err != nil {
+		return Resource{}, fmt.Errorf("deployment file %s: %v", name, err)
+	}
+
+	var o parseOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return parseDeploymentFile(name, deploymentVars, o)
+}
+
+func parseDeploymentFile(name string, deploymentVars map[string]string, o parseOptions) (Resource, error) {
+	content, name, err := readDeploymentFile(name)
+	if err != nil {
+		return Resource{}, err
+	}
+	// Don't parse file with the suffix "noparse".
+	if !noParse(name) {
+		vars, err := o.varsForFile(name, deploymentVars)
+		if err != nil {
+			return Resource{}, err
+		}
+		content, err = applyTemplateVars(filepath.Dir(name), content, vars)
+		if err != nil {
+			return Resource{}, fmt.Errorf("couldn't apply template to file %s: %v", name, err)
+		}
+		if len(bytes.TrimSpace(content)) == 0 {
+			if o.strict {
+				return Resource{}, fmt.Errorf("template of file %s rendered to nothing", name)
 			}
+			log.Printf("Warning: template of file %s rendered to nothing, no resources will be created from it", name)
 		}
-		deploymentObjects = append(deploymentObjects, Resource{FileName: name, Content: content})
 	}
-	return deploymentObjects, nil
+	if len(o.labels) > 0 || len(o.annotations) > 0 {
+		content, err = injectMetadata(content, o.labels, o.annotations)
+		if err != nil {
+			return Resource{}, fmt.Errorf("couldn't inject metadata to file %s: %v", name, err)
+		}
+	}
+	return Resource{
+		FileName: name,
+		Content:  content,
+		Metadata: objectsMetadata(content),
+	}, nil
+}
+
+// RequiredVars returns the sorted names of the variables referenced by the deployment files,
+// without executing the templates.
+func RequiredVars(deploymentFiles []string) ([]string, error) {
+	fileList, err := deploymentFileList(deploymentFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := map[string]struct{}{}
+	for _, name := range fileList {
+		content, name, err := readDeploymentFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if noParse(name) {
+			continue
+		}
+		t, err := template.New("resource").Funcs(templateFuncs(filepath.Dir(name), 0)).Parse(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse template file %s: %v", name, err)
+		}
+		if err := collectVars(t.Root, filepath.Dir(name), 0, true, vars); err != nil {
+			return nil, fmt.Errorf("couldn't collect the variables of %s: %v", name, err)
+		}
+	}
+
+	res := make([]string, 0, len(vars))
+	for v := range vars {
+		res = append(res, v)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// collectVars adds the names of the deployment variables referenced by the node to vars.
+// The dot only refers to the deployment variables until a range or with block rebinds it,
+// while $ always refers to them. Partials included with the deployment variables are
+// resolved relative to dir, the same as when rendering.
+func collectVars(node parse.Node, dir string, depth int, rootDot bool, vars map[string]struct{}) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Nodes {
+			if err := collectVars(c, dir, depth, rootDot, vars); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return collectVars(n.Pipe, dir, depth, rootDot, vars)
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Cmds {
+			if err := collectVars(c, dir, depth, rootDot, vars); err != nil {
+				return err
+			}
+		}
+	case *parse.CommandNode:
+		if len(n.Args) >= 3 && isIdentifier(n.Args[0], "index") && isRootData(n.Args[1], rootDot) {
+			if key, ok := n.Args[2].(*parse.StringNode); ok {
+				vars[key.Text] = struct{}{}
+			}
+		}
+		// Only partials included with the deployment variables reference them.
+		if len(n.Args) == 3 && isIdentifier(n.Args[0], "include") && isRootData(n.Args[2], rootDot) {
+			if name, ok := n.Args[1].(*parse.StringNode); ok {
+				if err := collectIncludeVars(dir, name.Text, depth, vars); err != nil {
+					return err
+				}
+			}
+		}
+		for _, a := range n.Args {
+			if err := collectVars(a, dir, depth, rootDot, vars); err != nil {
+				return err
+			}
+		}
+	case *parse.FieldNode:
+		if rootDot {
+			vars[n.Ident[0]] = struct{}{}
+		}
+	case *parse.VariableNode:
+		if n.Ident[0] == "$" && len(n.Ident) > 1 {
+			vars[n.Ident[1]] = struct{}{}
+		}
+	case *parse.ChainNode:
+		return collectVars(n.Node, dir, depth, rootDot, vars)
+	case *parse.IfNode:
+		return collectBranchVars(&n.BranchNode, dir, depth, rootDot, rootDot, vars)
+	case *parse.RangeNode:
+		return collectBranchVars(&n.BranchNode, dir, depth, rootDot, false, vars)
+	case *parse.WithNode:
+		return collectBranchVars(&n.BranchNode, dir, depth, rootDot, false, vars)
+	case *parse.TemplateNode:
+		return collectVars(n.Pipe, dir, depth, rootDot, vars)
+	}
+	return nil
+}
+
+// collectBranchVars adds the variables referenced by the pipeline and the lists of a branch to vars.
+// listDot tells whether the dot still refers to the deployment variables within the list.
+func collectBranchVars(n *parse.BranchNode, dir string, depth int, rootDot, listDot bool, vars map[string]struct{}) error {
+	if err := collectVars(n.Pipe, dir, depth, rootDot, vars); err != nil {
+		return err
+	}
+	if err := collectVars(n.List, dir, depth, listDot, vars); err != nil {
+		return err
+	}
+	return collectVars(n.ElseList, dir, depth, rootDot, vars)
+}
+
+// collectIncludeVars adds the variables referenced by the partial included from dir to vars.
+func collectIncludeVars(dir, name string, depth int, vars map[string]struct{}) error {
+	if depth >= maxIncludeDepth {
+		return fmt.Errorf("including %s exceeds the maximum include depth of %d, the includes might be cyclic", name, maxIncludeDepth)
+	}
+	path, err := templateFile(dir, name)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	t, err := template.New(name).Funcs(templateFuncs(filepath.Dir(path), depth+1)).Parse(string(content))
+	if err != nil {
+		return fmt.Errorf("couldn't parse included file %s: %v", name, err)
+	}
+	return collectVars(t.Root, filepath.Dir(path), depth+1, true, vars)
+}
+
+// isIdentifier returns whether the node is the function identifier name.
+func isIdentifier(node parse.Node, name string) bool {
+	n, ok := node.(*parse.IdentifierNode)
+	return ok && n.Ident == name
+}
+
+// isRootData returns whether the node is the deployment variables, ie. $ or the dot outside of a range or with block.
+func isRootData(node parse.Node, rootDot bool) bool {
+	switch n := node.(type) {
+	case *parse.DotNode:
+		return rootDot
+	case *parse.VariableNode:
+		return len(n.Ident) == 1 && n.Ident[0] == "$"
+	}
+	return false
+}
+
+// WriteResources writes the content of each resource to dir/<FileName>,
+// creating the subdirectories as needed.
+func WriteResources(dir string, resources []Resource) error {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range resources {
+		name := filepath.Join(absDir, r.FileName)
+		if !strings.HasPrefix(name, absDir+string(filepath.Separator)) {
+			return fmt.Errorf("resource file %s is outside of %s", r.FileName, dir)
+		}
+		if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+			return fmt.Errorf("error creating directory for %s: %v", name, err)
+		}
+		if err := ioutil.WriteFile(name, r.Content, 0644); err != nil {
+			return fmt.Errorf("error writing file %s: %v", name, err)
+		}
+	}
+	log.Printf("Wrote %d resource files to %s", len(resources), dir)
+	return nil
+}
+
+// WriteResourcesTar writes the content of each resource as an entry named by its FileName to a tar archive.
+// The entries are sorted by name and have a fixed modification time, so that the archive is reproducible.
+func WriteResourcesTar(w io.Writer, resources []Resource) error {
+	sorted := make([]Resource, len(resources))
+	copy(sorted, resources)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].FileName < sorted[j].FileName })
+
+	tw := tar.NewWriter(w)
+	for _, r := range sorted {
+		name := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(r.FileName)), "/")
+		if name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("resource file %s is outside of the archive", r.FileName)
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(r.Content)),
+			ModTime:  time.Unix(0, 0),
+		}); err != nil {
+			return fmt.Errorf("error writing header of %s: %v", name, err)
+		}
+		if _, err := tw.Write(r.Content); err != nil {
+			return fmt.Errorf("error writing %s: %v", name, err)
+		}
+	}
+	return tw.Close()
 }
 
 // MergeDeploymentVars merges multiple maps based on the order.
@@ -145,3 +763,42 @@ func MergeDeploymentVars(ms ...map[string]string) map[string]string {
 	}
 	return res
 }
+
+// VarsFromEnv returns the deployment variables set as environment variables with the prefix,
+// eg. PROMBENCH_PR_NUMBER=35 with the PROMBENCH_ prefix results in PR_NUMBER=35.
+// The prefix is stripped and the case of the remaining name is kept,
+// as it has to match the variables used in the deployment files.
+func VarsFromEnv(prefix string) map[string]string {
+	vars := map[string]string{}
+	for _, e := range os.Environ() {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], prefix) || kv[0] == prefix {
+			continue
+		}
+		vars[strings.TrimPrefix(kv[0], prefix)] = kv[1]
+	}
+	return vars
+}
+
+// DiffVars compares two sets of deployment variables and returns the sorted keys
+// only present in b, only present in a and present in both with different values.
+func DiffVars(a, b map[string]string) (added, removed, changed []string) {
+	for k, v := range a {
+		bv, ok := b[k]
+		switch {
+		case !ok:
+			removed = append(removed, k)
+		case bv != v:
+			changed = append(changed, k)
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			added = append(added, k)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
@@ -14,7 +14,16 @@
 package provider
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -57,3 +66,673 @@ func TestMergeDeploymentVars(t *testing.T) {
 		}
 	}
 }
+
+func TestDiffVars(t *testing.T) {
+	a := map[string]string{
+		"CLUSTER_NAME": "prombench",
+		"PROJECT_ID":   "macro-mile-203600",
+		"ZONE":         "europe-west3-a",
+		"GKE_VERSION":  "1.14",
+	}
+	b := map[string]string{
+		"CLUSTER_NAME": "prombench",
+		"PROJECT_ID":   "prometheus-staging",
+		"ZONE":         "europe-west3-b",
+		"PR_NUMBER":    "35",
+	}
+
+	added, removed, changed := DiffVars(a, b)
+	if expected := []string{"PR_NUMBER"}; !reflect.DeepEqual(expected, added) {
+		t.Errorf("added: expect %v, got %v", expected, added)
+	}
+	if expected := []string{"GKE_VERSION"}; !reflect.DeepEqual(expected, removed) {
+		t.Errorf("removed: expect %v, got %v", expected, removed)
+	}
+	if expected := []string{"PROJECT_ID", "ZONE"}; !reflect.DeepEqual(expected, changed) {
+		t.Errorf("changed: expect %v, got %v", expected, changed)
+	}
+
+	added, removed, changed = DiffVars(a, a)
+	if len(added) != 0 || len(removed) != 0 || len(changed) != 0 {
+		t.Errorf("expect no differences for equal vars, got added %v, removed %v, changed %v", added, removed, changed)
+	}
+}
+
+func TestVarsFromEnv(t *testing.T) {
+	env := map[string]string{
+		"PROMBENCH_TEST_PR_NUMBER": "35",
+		"PROMBENCH_TEST_RELEASE":   "v2.20.0",
+		"PROMBENCH_TEST_":          "empty name",
+		"OTHER_PROMBENCH_TEST_FOO": "bar",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	expected := map[string]string{"PR_NUMBER": "35", "RELEASE": "v2.20.0"}
+	if vars := VarsFromEnv("PROMBENCH_TEST_"); !reflect.DeepEqual(expected, vars) {
+		t.Errorf("\nexpect %v\ngot %v", expected, vars)
+	}
+}
+
+func TestWriteResources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_write_resources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	resources := []Resource{
+		{FileName: "1_namespace.yaml", Content: []byte("kind: Namespace")},
+		{FileName: "manifests/benchmark/2_job.yaml", Content: []byte("kind: Job")},
+	}
+	if err := WriteResources(dir, resources); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range resources {
+		content, err := ioutil.ReadFile(filepath.Join(dir, r.FileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, r.Content) {
+			t.Errorf("\nexpect %s\ngot %s", r.Content, content)
+		}
+	}
+
+	if err := WriteResources(dir, []Resource{{FileName: "../outside.yaml"}}); err == nil {
+		t.Errorf("expected an error writing outside of %s", dir)
+	}
+}
+
+func TestWriteResourcesTar(t *testing.T) {
+	resources := []Resource{
+		{FileName: "manifests/benchmark/2_job.yaml", Content: []byte("kind: Job")},
+		{FileName: "1_namespace.yaml", Content: []byte("kind: Namespace")},
+	}
+	var buf bytes.Buffer
+	if err := WriteResourcesTar(&buf, resources); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range resources {
+			if r.FileName == h.Name && !bytes.Equal(content, r.Content) {
+				t.Errorf("%s:\nexpect %s\ngot %s", h.Name, r.Content, content)
+			}
+		}
+		names = append(names, h.Name)
+	}
+	if expected := []string{"1_namespace.yaml", "manifests/benchmark/2_job.yaml"}; !reflect.DeepEqual(expected, names) {
+		t.Errorf("expect entries %v, got %v", expected, names)
+	}
+
+	// The archive is reproducible.
+	var again bytes.Buffer
+	if err := WriteResourcesTar(&again, []Resource{resources[1], resources[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), again.Bytes()) {
+		t.Errorf("expect identical archives for the same resources")
+	}
+
+	if err := WriteResourcesTar(ioutil.Discard, []Resource{{FileName: "../outside.yaml"}}); err == nil {
+		t.Errorf("expected an error writing a file outside of the archive")
+	}
+}
+
+func TestDeploymentsParseGzip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_deployments_parse_gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte("name: prometheus-{{ .PR_NUMBER }}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "deploy.yaml.gz"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	resources, err := DeploymentsParse([]string{dir}, map[string]string{"PR_NUMBER": "35"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 1 {
+		t.Fatalf("expected 1 resource, got %d", len(resources))
+	}
+	if expected := filepath.Join(dir, "deploy.yaml"); resources[0].FileName != expected {
+		t.Errorf("expected file name %s, got %s", expected, resources[0].FileName)
+	}
+	if expected := "name: prometheus-35"; string(resources[0].Content) != expected {
+		t.Errorf("\nexpect %s\ngot %s", expected, resources[0].Content)
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.yaml.gz")
+	if err := ioutil.WriteFile(corrupt, []byte("not gzip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeploymentsParse([]string{corrupt}, nil); err == nil {
+		t.Errorf("expected an error for a corrupt gzip file")
+	}
+}
+
+func TestRequiredVars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_required_vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"1_deployment.yaml": `
+name: prometheus-{{ .PR_NUMBER }}
+image: {{ normalise .RELEASE | printf "prom/prometheus:%s" }}
+{{- if .NGINX_SERVICE_TYPE }}
+type: {{ .NGINX_SERVICE_TYPE }}
+{{- else }}
+type: {{ .DEFAULT_SERVICE_TYPE }}
+{{- end }}
+{{- range $subnetId := split .EKS_SUBNET_IDS .SEPARATOR }}
+- {{ $subnetId }}-{{ $.ZONE }}
+{{- end }}
+{{- with .NODE_POOL }}
+pool: {{ .Name }}
+{{- end }}
+{{ include "labels.tpl" . }}
+{{ include "pool.tpl" .NODE_POOL }}
+run: {{ index $ "RUN_ID" }}`,
+		"2_dashboards_noparse.yaml": `{{ .NOT_A_VAR }}`,
+		// Partials aren't deployment files but their variables are required when included.
+		"labels.tpl": `app: {{ .APP }}
+{{ include "nested.tpl" $ }}`,
+		"nested.tpl": `env: {{ index . "ENV" }}`,
+		// Included with the value of a variable instead of the deployment variables.
+		"pool.tpl": `{{ .Zone }}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vars, err := RequiredVars([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"APP", "DEFAULT_SERVICE_TYPE", "EKS_SUBNET_IDS", "ENV", "NGINX_SERVICE_TYPE", "NODE_POOL", "PR_NUMBER", "RELEASE", "RUN_ID", "SEPARATOR", "ZONE"}
+	if !reflect.DeepEqual(expected, vars) {
+		t.Errorf("\nexpect %v\ngot %v", expected, vars)
+	}
+
+	// Cyclic includes fail the same as when rendering.
+	if err := ioutil.WriteFile(filepath.Join(dir, "nested.tpl"), []byte(`{{ include "labels.tpl" . }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RequiredVars([]string{dir}); err == nil || !strings.Contains(err.Error(), "maximum include depth") {
+		t.Errorf("expected an error about the include depth, got %v", err)
+	}
+}
+
+func TestDeploymentsParseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_deployments_parse_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "manifests", "scripts"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"secret.txt":                     "secret",
+		"manifests/scripts/init.sh":      "echo init",
+		"manifests/1_configmap.yaml":     `init.sh: {{ file "scripts/init.sh" | printf "%q" }}`,
+		"manifests/2_traversal.yaml.bak": `secret: {{ file "../secret.txt" }}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resources, err := DeploymentsParse([]string{filepath.Join(dir, "manifests", "1_configmap.yaml")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `init.sh: "echo init"`; string(resources[0].Content) != expected {
+		t.Errorf("\nexpect %s\ngot %s", expected, resources[0].Content)
+	}
+
+	if _, err := DeploymentsParse([]string{filepath.Join(dir, "manifests", "2_traversal.yaml.bak")}, nil); err == nil {
+		t.Errorf("expected an error reading a file outside of the deployment file directory")
+	}
+}
+
+func TestDeploymentsParseInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_deployments_parse_include")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "partials"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"partials/labels.yaml": "release: {{ .RELEASE }}",
+		"partials/probes.yaml": "readinessProbe:\n  path: /-/ready\n{{ include \"labels.yaml\" . }}",
+		"partials/cycle.yaml":  `{{ include "cycle.yaml" . }}`,
+		"1_prometheus.yaml":    "kind: Deployment\n{{ include \"partials/probes.yaml\" . }}\n",
+		"2_cycle.yaml.bak":     `{{ include "partials/cycle.yaml" . }}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resources, err := DeploymentsParse([]string{filepath.Join(dir, "1_prometheus.yaml")}, map[string]string{"RELEASE": "master"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "kind: Deployment\nreadinessProbe:\n  path: /-/ready\nrelease: master\n"; string(resources[0].Content) != expected {
+		t.Errorf("\nexpect %s\ngot %s", expected, resources[0].Content)
+	}
+
+	// The partials aren't deployment files of the directory.
+	resources, err = DeploymentsParse([]string{dir}, map[string]string{"RELEASE": "master"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 1 || filepath.Base(resources[0].FileName) != "1_prometheus.yaml" {
+		var names []string
+		for _, r := range resources {
+			names = append(names, r.FileName)
+		}
+		t.Errorf("expected only 1_prometheus.yaml to be parsed, got %v", names)
+	}
+
+	_, err = DeploymentsParse([]string{filepath.Join(dir, "2_cycle.yaml.bak")}, nil)
+	if err == nil || !strings.Contains(err.Error(), "maximum include depth") {
+		t.Errorf("expected an error for a cyclic include, got %v", err)
+	}
+}
+
+func TestDeploymentsParseMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_deployments_parse_metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: prometheus-test-{{ .PR_NUMBER }}
+  namespace: prombench-{{ .PR_NUMBER }}
+spec:
+  replicas: 1
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: prometheus-test
+data:
+  prometheus.yaml: |
+    global:
+      scrape_interval: 15s
+---
+# Not a k8s object.
+- foo
+`
+	file := filepath.Join(dir, "deployment.yaml")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	resources, err := DeploymentsParse([]string{file}, map[string]string{"PR_NUMBER": "35"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ObjectMetadata{
+		{APIVersion: "apps/v1", Kind: "Deployment", Name: "prometheus-test-35", Namespace: "prombench-35"},
+		{APIVersion: "v1", Kind: "ConfigMap", Name: "prometheus-test"},
+	}
+	if !reflect.DeepEqual(expected, resources[0].Metadata) {
+		t.Errorf("\nexpect %+v\ngot %+v", expected, resources[0].Metadata)
+	}
+}
+
+func TestNormaliseName(t *testing.T) {
+	testCases := map[string]string{
+		"v2.19.0":                      "v2-19-0",
+		"Prometheus-Test":              "prometheus-test",
+		"feature/foo_bar..baz":         "feature-foo-bar-baz",
+		"--release@v1!--":              "release-v1",
+		strings.Repeat("a", 70):        strings.Repeat("a", 63),
+		strings.Repeat("a", 62) + ".b": strings.Repeat("a", 62),
+	}
+	for in, expected := range testCases {
+		if out := normaliseName(in); out != expected {
+			t.Errorf("normaliseName(%q): expect %q, got %q", in, expected, out)
+		}
+	}
+
+	out, err := applyTemplateVars(".", []byte(`{{ normaliseName .RELEASE }}`), map[string]string{"RELEASE": "Feature/Foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "feature-foo"; string(out) != expected {
+		t.Errorf("\nexpect %s\ngot %s", expected, out)
+	}
+}
+
+func TestDeploymentsParseCommonMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_deployments_parse_common_metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: prometheus-test
+  labels:
+    app.kubernetes.io/managed-by: helm
+data:
+  foo: bar
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: prombench
+---
+# Not a k8s object.
+- foo
+`
+	file := filepath.Join(dir, "deployment.yaml")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	resources, err := DeploymentsParse([]string{file}, nil, WithCommonMetadata(
+		map[string]string{"app.kubernetes.io/managed-by": "prombench", "app.kubernetes.io/part-of": "prombench"},
+		map[string]string{"prombench.prometheus.io/source": "test-infra"},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: prometheus-test
+  labels:
+    app.kubernetes.io/managed-by: helm
+    app.kubernetes.io/part-of: prombench
+  annotations:
+    prombench.prometheus.io/source: test-infra
+data:
+  foo: bar
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: prombench
+  labels:
+    app.kubernetes.io/managed-by: prombench
+    app.kubernetes.io/part-of: prombench
+  annotations:
+    prombench.prometheus.io/source: test-infra
+---
+# Not a k8s object.
+- foo
+`
+	if string(resources[0].Content) != expected {
+		t.Errorf("\nexpect %s\ngot %s", expected, resources[0].Content)
+	}
+}
+
+func TestDeploymentsParseFileVars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_deployments_parse_file_vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := "replicas: {{ .REPLICAS }}\nrelease: {{ .RELEASE }}\n"
+	for _, name := range []string{"1_prometheus.yaml", "2_loadgen.yaml"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resources, err := DeploymentsParse([]string{dir},
+		map[string]string{"REPLICAS": "1", "RELEASE": "master"},
+		WithFileVars(map[string]map[string]string{"*_loadgen.yaml": {"REPLICAS": "3"}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"1_prometheus.yaml": "replicas: 1\nrelease: master\n",
+		"2_loadgen.yaml":    "replicas: 3\nrelease: master\n",
+	}
+	for _, r := range resources {
+		if string(r.Content) != expected[filepath.Base(r.FileName)] {
+			t.Errorf("%s:\nexpect %s\ngot %s", r.FileName, expected[filepath.Base(r.FileName)], r.Content)
+		}
+	}
+
+	if _, err := DeploymentsParse([]string{dir}, nil, WithFileVars(map[string]map[string]string{"[": {"REPLICAS": "3"}})); err == nil {
+		t.Error("expect an error for an invalid file glob")
+	}
+}
+
+func TestDeploymentsParseEmptyRender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_deployments_parse_empty_render")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "1_loadgen.yaml")
+	content := "{{ if .LOADGEN }}\nkind: Deployment\n{{ end }}\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	if _, err := DeploymentsParse([]string{file}, map[string]string{"LOADGEN": ""}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), file) {
+		t.Errorf("expect a warning naming %s, got %q", file, buf.String())
+	}
+
+	_, err = DeploymentsParse([]string{file}, map[string]string{"LOADGEN": ""}, WithStrictRender())
+	if err == nil || !strings.Contains(err.Error(), file) {
+		t.Errorf("expect an error naming %s, got %v", file, err)
+	}
+
+	buf.Reset()
+	if _, err := DeploymentsParse([]string{file}, map[string]string{"LOADGEN": "true"}, WithStrictRender()); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expect no warning, got %q", buf.String())
+	}
+}
+
+func TestDeploymentsParseChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_deployments_parse_changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"1_prometheus.yaml": "release: {{ .RELEASE }}\n",
+		"2_loadgen.yaml":    "replicas: 1\n",
+		"3_removed.yaml":    "kind: Namespace\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resources, checksums, err := DeploymentsParseChanged([]string{dir}, map[string]string{"RELEASE": "master"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 3 || len(checksums) != 3 {
+		t.Fatalf("expect all 3 resources and checksums on the first parse, got %d resources and %d checksums", len(resources), len(checksums))
+	}
+
+	if err := os.Remove(filepath.Join(dir, "3_removed.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "4_added.yaml"), []byte("kind: ConfigMap\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	previous := checksums
+	resources, checksums, err = DeploymentsParseChanged([]string{dir}, map[string]string{"RELEASE": "v2.20.0"}, previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var changed []string
+	for _, r := range resources {
+		changed = append(changed, filepath.Base(r.FileName))
+		if checksums[r.FileName] != r.Checksum() {
+			t.Errorf("expect checksum %s for %s, got %s", r.Checksum(), r.FileName, checksums[r.FileName])
+		}
+	}
+	if expected := []string{"1_prometheus.yaml", "4_added.yaml"}; !reflect.DeepEqual(expected, changed) {
+		t.Errorf("expect changed resources %v, got %v", expected, changed)
+	}
+
+	loadgen := filepath.Join(dir, "2_loadgen.yaml")
+	if checksums[loadgen] != previous[loadgen] {
+		t.Errorf("expect unchanged checksum for %s", loadgen)
+	}
+	if _, ok := checksums[filepath.Join(dir, "3_removed.yaml")]; ok || len(checksums) != 3 {
+		t.Errorf("expect the checksum of the removed file to be dropped, got %v", checksums)
+	}
+}
+
+func TestDeploymentParseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_deployment_parse_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"1_prometheus.yaml": "name: prometheus-{{ .PR_NUMBER }}\n",
+		"README.md":         "# Manifests\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := DeploymentParseFile(filepath.Join(dir, "1_prometheus.yaml"), map[string]string{"PR_NUMBER": "35"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "name: prometheus-35\n"; string(r.Content) != expected {
+		t.Errorf("\nexpect %s\ngot %s", expected, r.Content)
+	}
+
+	for _, name := range []string{"README.md", "3_missing.yaml"} {
+		if _, err := DeploymentParseFile(filepath.Join(dir, name), nil); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("expect an error mentioning %s, got %v", name, err)
+		}
+	}
+}
+
+func TestGroupByKind(t *testing.T) {
+	resources := []Resource{
+		{
+			FileName: "1_namespace.yaml",
+			Content:  []byte("apiVersion: v1\nkind: Namespace\nmetadata:\n  name: prombench\n"),
+		},
+		{
+			FileName: "2_prometheus.yaml",
+			Content: []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: prometheus-config
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: prometheus
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: prometheus-rules
+---
+# Not a k8s object.
+- foo
+`),
+		},
+	}
+
+	groups := GroupByKind(resources)
+
+	names := map[string][]string{}
+	for kind, rs := range groups {
+		for _, r := range rs {
+			name := r.FileName
+			if len(r.Metadata) > 0 {
+				name = r.Metadata[0].Name
+			}
+			names[kind] = append(names[kind], name)
+		}
+	}
+	expected := map[string][]string{
+		"Namespace": {"prombench"},
+		"ConfigMap": {"prometheus-config", "prometheus-rules"},
+		"Service":   {"prometheus"},
+		UnknownKind: {"2_prometheus.yaml"},
+	}
+	if !reflect.DeepEqual(expected, names) {
+		t.Errorf("\nexpect %v\ngot %v", expected, names)
+	}
+	if expected := "apiVersion: v1\nkind: Service\nmetadata:\n  name: prometheus\n"; string(groups["Service"][0].Content) != expected {
+		t.Errorf("\nexpect %s\ngot %s", expected, groups["Service"][0].Content)
+	}
+}